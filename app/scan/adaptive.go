@@ -0,0 +1,108 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+const (
+	adaptiveWindow        = time.Second
+	adaptiveMinQueries    = 10   // Windows with fewer queries won't change the rate.
+	adaptiveMaxFailRatio  = 0.05 // Ratio of timeouts and REFUSED that cuts the rate.
+	adaptiveLatencyFactor = 2    // Latency above baseline * factor stops increasing the rate.
+	adaptiveDecrease      = 0.5
+	adaptiveIncreaseSteps = 20 // The rate increases max / steps per window.
+)
+
+// adaptiveRate adjusts the limit of a rate.Limiter in AIMD style. The limit
+// increases additively while queries are healthy, and is cut multiplicatively
+// when timeouts or REFUSED responses spike.
+type adaptiveRate struct {
+	l        *rate.Limiter
+	min, max float64
+
+	m        sync.Mutex
+	cur      float64
+	queries  int
+	failures int
+	latency  time.Duration // Sum of latencies of successful queries in the window.
+	baseline time.Duration // Lowest average latency of all windows.
+}
+
+// newAdaptiveRate creates an adaptiveRate that starts at max / 10.
+func newAdaptiveRate(l *rate.Limiter, maxRate float64) *adaptiveRate {
+	a := &adaptiveRate{l: l, min: 1, max: maxRate}
+	a.set(max(a.min, maxRate/10))
+	return a
+}
+
+// observe records the result of a query.
+func (a *adaptiveRate) observe(latency time.Duration, resp *dns.Msg, err error) {
+	failed := errors.Is(err, context.DeadlineExceeded) || (err == nil && resp.Rcode == dns.RcodeRefused)
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.queries++
+	if failed {
+		a.failures++
+	} else if err == nil {
+		a.latency += latency
+	}
+}
+
+// adjust adjusts the rate with the stats of the last window and resets them.
+func (a *adaptiveRate) adjust() {
+	a.m.Lock()
+	defer a.m.Unlock()
+	queries, failures, latency := a.queries, a.failures, a.latency
+	a.queries, a.failures, a.latency = 0, 0, 0
+	if queries < adaptiveMinQueries {
+		return
+	}
+
+	if float64(failures)/float64(queries) > adaptiveMaxFailRatio {
+		a.set(max(a.min, a.cur*adaptiveDecrease))
+		return
+	}
+	if ok := queries - failures; ok > 0 {
+		avg := latency / time.Duration(ok)
+		if a.baseline == 0 || avg < a.baseline {
+			a.baseline = avg
+		}
+		if avg > a.baseline*adaptiveLatencyFactor {
+			return
+		}
+	}
+	a.set(min(a.max, a.cur+a.max/adaptiveIncreaseSteps))
+}
+
+func (a *adaptiveRate) set(r float64) {
+	a.cur = r
+	a.l.SetLimit(rate.Limit(r))
+	a.l.SetBurst(max(1, int(r)))
+}
+
+// rate returns the current rate.
+func (a *adaptiveRate) rate() float64 {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.cur
+}
+
+// run calls adjust every window until ctx is done.
+func (a *adaptiveRate) run(ctx context.Context) {
+	t := time.NewTicker(adaptiveWindow)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			a.adjust()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package scan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func Test_adaptiveRate(t *testing.T) {
+	r := require.New(t)
+	l := rate.NewLimiter(100, 100)
+	a := newAdaptiveRate(l, 100)
+	r.Equal(10.0, a.rate())
+	r.Equal(rate.Limit(10), l.Limit())
+
+	ok := new(dns.Msg)
+	refused := new(dns.Msg).SetRcode(new(dns.Msg), dns.RcodeRefused)
+	window := func(n, failures int, latency time.Duration) {
+		for i := 0; i < n; i++ {
+			if i < failures {
+				a.observe(latency, refused, nil)
+			} else {
+				a.observe(latency, ok, nil)
+			}
+		}
+		a.adjust()
+	}
+
+	// Healthy windows increase the rate additively.
+	window(20, 0, time.Millisecond*10)
+	r.Equal(15.0, a.rate())
+	window(20, 0, time.Millisecond*15)
+	r.Equal(20.0, a.rate())
+
+	// High latency stops the increase.
+	window(20, 0, time.Millisecond*50)
+	r.Equal(20.0, a.rate())
+
+	// Too few queries.
+	window(5, 5, time.Millisecond*10)
+	r.Equal(20.0, a.rate())
+
+	// Spike of REFUSED and timeouts cuts the rate.
+	window(20, 10, time.Millisecond*10)
+	r.Equal(10.0, a.rate())
+	for i := 0; i < 20; i++ {
+		a.observe(time.Second, nil, context.DeadlineExceeded)
+	}
+	a.adjust()
+	r.Equal(5.0, a.rate())
+	r.Equal(rate.Limit(5), l.Limit())
+
+	// Never exceeds the max.
+	for i := 0; i < 50; i++ {
+		window(20, 0, time.Millisecond*10)
+	}
+	r.Equal(100.0, a.rate())
+}
@@ -0,0 +1,146 @@
+package scan
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	authLimiterPrefixV4   = 24
+	authLimiterPrefixV6   = 48
+	maxAuthLimiterEntries = 1 << 16 // Least recently used limiters will be removed when exceeded.
+)
+
+// errAuthLimited means a query was not sent because waiting for the
+// authLimiter would exceed the deadline of its context.
+var errAuthLimited = errors.New("auth limiter wait would exceed context deadline")
+
+// authLimiter limits queries to each authoritative server address and
+// to each network (/24 for IPv4, /48 for IPv6) that the address is in.
+// It is safe for concurrent use.
+type authLimiter struct {
+	now func() time.Time // Nil means time.Now. (tests)
+
+	m        sync.Mutex
+	addrs    *limiterLRU[netip.Addr]   // Nil means no limit.
+	prefixes *limiterLRU[netip.Prefix] // Nil means no limit.
+}
+
+func newAuthLimiter(perAddr, perPrefix int) *authLimiter {
+	l := new(authLimiter)
+	if perAddr > 0 {
+		l.addrs = newLimiterLRU[netip.Addr](maxAuthLimiterEntries, rate.Limit(perAddr))
+	}
+	if perPrefix > 0 {
+		l.prefixes = newLimiterLRU[netip.Prefix](maxAuthLimiterEntries, rate.Limit(perPrefix))
+	}
+	return l
+}
+
+// wait blocks until a query can be sent to addr or ctx is done.
+// Tokens of addr and its network are reserved together. If wait
+// fails, both of them are returned.
+func (l *authLimiter) wait(ctx context.Context, addr netip.Addr) error {
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	rs, delay := l.reserve(now, addr)
+	if delay == 0 {
+		return nil
+	}
+	cancel := func() {
+		for _, r := range rs {
+			r.CancelAt(now)
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(now) < delay {
+		cancel()
+		return fmt.Errorf("%w, delay %s", errAuthLimited, delay)
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+// reserve reserves a token of addr and a token of its network at now.
+// It returns the reservations and how long to wait for both tokens.
+func (l *authLimiter) reserve(now time.Time, addr netip.Addr) ([]*rate.Reservation, time.Duration) {
+	addr = addr.Unmap()
+	bits := authLimiterPrefixV6
+	if addr.Is4() {
+		bits = authLimiterPrefixV4
+	}
+	prefix, _ := addr.Prefix(bits)
+
+	var rs []*rate.Reservation
+	l.m.Lock()
+	if l.prefixes != nil {
+		rs = append(rs, l.prefixes.get(prefix).ReserveN(now, 1))
+	}
+	if l.addrs != nil {
+		rs = append(rs, l.addrs.get(addr).ReserveN(now, 1))
+	}
+	l.m.Unlock()
+
+	var delay time.Duration
+	for _, r := range rs {
+		delay = max(delay, r.DelayFrom(now))
+	}
+	return rs, delay
+}
+
+// limiterLRU is a lru cache of rate limiters. It is not safe for concurrent use.
+// Removed limiters lose their state. The least recently used one is
+// normally idle and has a full bucket anyway.
+type limiterLRU[K comparable] struct {
+	size int
+	r    rate.Limit
+
+	l  *list.List          // *limiterEntry[K], most recently used first.
+	em map[K]*list.Element // key -> element in l
+}
+
+type limiterEntry[K comparable] struct {
+	key K
+	rl  *rate.Limiter
+}
+
+func newLimiterLRU[K comparable](size int, r rate.Limit) *limiterLRU[K] {
+	return &limiterLRU[K]{
+		size: size,
+		r:    r,
+		l:    list.New(),
+		em:   make(map[K]*list.Element),
+	}
+}
+
+// get returns the limiter of k, or creates one. The burst of a new limiter
+// is its rate.
+func (c *limiterLRU[K]) get(k K) *rate.Limiter {
+	if e := c.em[k]; e != nil {
+		c.l.MoveToFront(e)
+		return e.Value.(*limiterEntry[K]).rl
+	}
+	for c.l.Len() >= c.size {
+		e := c.l.Back()
+		c.l.Remove(e)
+		delete(c.em, e.Value.(*limiterEntry[K]).key)
+	}
+	rl := rate.NewLimiter(c.r, max(1, int(c.r)))
+	c.em[k] = c.l.PushFront(&limiterEntry[K]{key: k, rl: rl})
+	return rl
+}
@@ -0,0 +1,80 @@
+package scan
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_authLimiter(t *testing.T) {
+	r := require.New(t)
+	l := newAuthLimiter(10, 15)
+	now := time.Now()
+
+	// Burst of an address is its qps.
+	a1 := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 10; i++ {
+		_, delay := l.reserve(now, a1)
+		r.Zero(delay)
+	}
+	_, delay := l.reserve(now, a1)
+	r.Equal(time.Second/10, delay)
+
+	// The /24 bucket is shared. 4 tokens left, the delayed reservation
+	// of a1 holds one.
+	a2 := netip.MustParseAddr("::ffff:192.0.2.2")
+	for i := 0; i < 4; i++ {
+		_, delay := l.reserve(now, a2)
+		r.Zero(delay)
+	}
+	r.Equal(1, l.prefixes.l.Len())
+	_, delay = l.reserve(now, a2)
+	r.Equal(time.Second/15, delay)
+
+	// Other networks are independent.
+	_, delay = l.reserve(now, netip.MustParseAddr("2001:db8::1"))
+	r.Zero(delay)
+	r.Equal(2, l.prefixes.l.Len())
+}
+
+func Test_authLimiter_cancel(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	l := newAuthLimiter(1, 2)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	a1 := netip.MustParseAddr("192.0.2.1")
+	r.NoError(l.wait(ctx, a1))
+
+	// a1 has no token. Failed waits return the token of the /24.
+	ctx2, cancel := context.WithDeadline(ctx, now.Add(time.Millisecond))
+	defer cancel()
+	r.ErrorIs(l.wait(ctx2, a1), errAuthLimited)
+	canceled, cancel2 := context.WithCancel(ctx)
+	cancel2()
+	r.ErrorIs(l.wait(canceled, a1), context.Canceled)
+
+	rs, delay := l.reserve(now, netip.MustParseAddr("192.0.2.2"))
+	r.Zero(delay)
+	r.True(rs[0].OK())
+	_, delay = l.reserve(now, netip.MustParseAddr("192.0.2.3"))
+	r.NotZero(delay)
+}
+
+func Test_limiterLRU(t *testing.T) {
+	r := require.New(t)
+	c := newLimiterLRU[int](2, 1)
+
+	l1 := c.get(1)
+	c.get(2)
+	r.Same(l1, c.get(1)) // 1 is the most recently used.
+	c.get(3)             // 2 is removed.
+	r.Equal(2, c.l.Len())
+	r.Len(c.em, 2)
+	r.Same(l1, c.get(1))
+	r.NotContains(c.em, 2)
+}
@@ -0,0 +1,218 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	errNoParentZone = errors.New("no parent zone found")
+	errNotAuth      = errors.New("no authoritative answer")
+	errNoReferral   = errors.New("no referral from parent zone")
+)
+
+// parentCacheTtl is the ttl of cached parent zone servers, in seconds.
+const parentCacheTtl = 3600
+
+// parentReferral is the delegation of a domain from its parent zone.
+type parentReferral struct {
+	nss  []string
+	glue []netip.Addr // Addresses of nss that are under the parent zone.
+	// The parent zone server is also authoritative for the domain.
+	// There is no referral, nss and glue are empty.
+	auth bool
+}
+
+// scanDelegation queries the NS set of fqdn from the parent zone servers
+// and from the child zone servers (nsAddrs) directly. If nsAddrs is empty
+// (e.g. the NS lookup through upstreams failed), child zone servers are
+// taken from the referral of the parent zone.
+func (s *scanner) scanDelegation(ctx context.Context, r *Result, fqdn string, nsAddrs []netip.Addr) {
+	ref, err := s.queryParentNs(ctx, fqdn)
+	if err != nil {
+		r.Errs = append(r.Errs, fmt.Sprintf("failed to lookup parent ns, %s", err))
+	} else {
+		r.ParentNss = ref.nss
+		r.ParentAuth = ref.auth
+		if len(nsAddrs) == 0 {
+			nsAddrs = s.referralAddrs(ctx, ref)
+		}
+	}
+
+	child, err := s.queryChildNs(ctx, fqdn, nsAddrs)
+	if err != nil {
+		r.Errs = append(r.Errs, fmt.Sprintf("failed to lookup child ns, %s", err))
+	}
+	r.ChildNss = child
+
+	if len(r.ParentNss) > 0 && len(child) > 0 {
+		mismatch := !equalNameSet(r.ParentNss, child)
+		r.NsMismatch = &mismatch
+	}
+	slices.Sort(r.ParentNss)
+	slices.Sort(r.ChildNss)
+}
+
+// queryParentNs asks a parent zone server for the delegation of fqdn.
+func (s *scanner) queryParentNs(ctx context.Context, fqdn string) (*parentReferral, error) {
+	servers, err := s.parentServers(ctx, fqdn)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := queryServers(ctx, s.exchangeAuth, servers, s.authPort, fqdn, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, rcodeError(resp.Rcode)
+	}
+
+	// Only a referral is the parent side data. If the parent server is also
+	// authoritative for the child zone, the response has the child side
+	// NS set, which can't be compared.
+	if resp.Authoritative || len(resp.Answer) > 0 {
+		return &parentReferral{auth: true}, nil
+	}
+	nss := nsOf(resp.Ns, fqdn)
+	if len(nss) == 0 {
+		return nil, errNoReferral
+	}
+	zone, _ := parentName(fqdn)
+	return &parentReferral{nss: nss, glue: glueAddrs(resp, zone, nss)}, nil
+}
+
+// referralAddrs returns addresses of the name servers in ref. Glue is
+// preferred. Otherwise, at most 4 name servers are looked up.
+func (s *scanner) referralAddrs(ctx context.Context, ref *parentReferral) []netip.Addr {
+	if len(ref.glue) > 0 {
+		return ref.glue
+	}
+	nss := ref.nss
+	if len(nss) > 4 {
+		nss = nss[:4]
+	}
+	hostAddrs, _ := s.resolveHosts(ctx, nss, "ns", true) // Failures are reported by queryChildNs.
+	var addrs []netip.Addr
+	for _, a := range hostAddrs {
+		addrs = append(addrs, a...)
+	}
+	return addrs
+}
+
+// queryChildNs asks the child zone servers for the NS set of fqdn.
+func (s *scanner) queryChildNs(ctx context.Context, fqdn string, nsAddrs []netip.Addr) ([]string, error) {
+	if len(nsAddrs) == 0 {
+		return nil, errNoServer
+	}
+	resp, err := queryServers(ctx, s.exchangeAuth, nsAddrs, s.authPort, fqdn, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, rcodeError(resp.Rcode)
+	}
+	if !resp.Authoritative {
+		return nil, errNotAuth
+	}
+	return nsOf(resp.Answer, fqdn), nil
+}
+
+// parentServers finds the closest enclosing zone of fqdn that has NS records
+// and returns addresses of its name servers. Addresses are cached under the
+// zone and the empty non-terminals between fqdn and the zone.
+func (s *scanner) parentServers(ctx context.Context, fqdn string) ([]netip.Addr, error) {
+	name, ok := parentName(fqdn)
+	if !ok {
+		return nil, errNoParentZone
+	}
+
+	var ents []string
+	for zone := name; ; {
+		addrs := s.parentZones.get(zone)
+		if len(addrs) == 0 {
+			nss, err := s.queryNs(ctx, zone)
+			if err != nil {
+				return nil, fmt.Errorf("failed to lookup ns of %s, %w", zone, err)
+			}
+			if len(nss) == 0 { // Not a zone.
+				ents = append(ents, zone)
+				if zone, ok = parentName(zone); !ok {
+					return nil, errNoParentZone
+				}
+				continue
+			}
+			addrs = s.resolveParentNss(ctx, nss)
+			if len(addrs) == 0 {
+				return nil, fmt.Errorf("failed to resolve ns of %s, %w", zone, errNoServer)
+			}
+			s.parentZones.store(zone, addrs, parentCacheTtl)
+		}
+		for _, ent := range ents {
+			s.parentZones.store(ent, addrs, parentCacheTtl)
+		}
+		return addrs, nil
+	}
+}
+
+// resolveParentNss returns addresses of the first name server in nss
+// that has addresses.
+func (s *scanner) resolveParentNss(ctx context.Context, nss []string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, ns := range nss {
+		for _, qt := range [...]uint16{dns.TypeA, dns.TypeAAAA} {
+			a, err := s.lookupAddr(ctx, ns, qt)
+			if err == nil {
+				addrs = append(addrs, a...)
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	return addrs
+}
+
+// parentName returns the parent domain of fqdn. ok is false if fqdn is root.
+func parentName(fqdn string) (parent string, ok bool) {
+	if fqdn == "." {
+		return "", false
+	}
+	off, end := dns.NextLabel(fqdn, 0)
+	if end {
+		return ".", true
+	}
+	return fqdn[off:], true
+}
+
+// nsOf returns NS targets in rrs that are owned by name.
+func nsOf(rrs []dns.RR, name string) []string {
+	var nss []string
+	for _, rr := range rrs {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, name) {
+			nss = append(nss, ns.Ns)
+		}
+	}
+	return nss
+}
+
+func equalNameSet(a, b []string) bool {
+	m := make(map[string]struct{}, len(a))
+	for _, s := range a {
+		m[strings.ToLower(s)] = struct{}{}
+	}
+	mb := make(map[string]struct{}, len(b))
+	for _, s := range b {
+		s = strings.ToLower(s)
+		if _, ok := m[s]; !ok {
+			return false
+		}
+		mb[s] = struct{}{}
+	}
+	return len(m) == len(mb)
+}
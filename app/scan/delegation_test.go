@@ -0,0 +1,111 @@
+package scan
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	dnsClient "github.com/IrineSistiana/nsloc/pkg/dns_client"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_scanner_scanDelegation(t *testing.T) {
+	r := require.New(t)
+	zones := testZones(t)
+
+	roots, err := parseRootHints(strings.NewReader(testRootHints))
+	r.NoError(err)
+	s := &scanner{authUDP: zones, authTCP: zones, authPort: 53, parentZones: newZoneCache()}
+	s.iter = newIterResolver(roots, 53, s.exchangeAuth)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	res := new(Result)
+	s.scanDelegation(ctx, res, "example.com.", []netip.Addr{netip.MustParseAddr("127.0.0.3")})
+	r.Empty(res.Errs)
+	r.False(res.ParentAuth)
+	r.Equal([]string{"ns.example-dns.com.", "ns1.example.com."}, res.ParentNss)
+	r.Equal([]string{"ns1.example.com.", "ns2.example.com."}, res.ChildNss)
+	r.NotNil(res.NsMismatch)
+	r.True(*res.NsMismatch)
+	comServers := s.parentZones.get("com.")
+	r.Equal([]netip.Addr{netip.MustParseAddr("127.0.0.2")}, comServers)
+
+	// Servers of the enclosing zone are cached under empty non-terminals.
+	servers, err := s.parentServers(ctx, "x.ent.example.com.")
+	r.NoError(err)
+	r.Equal(servers, s.parentZones.get("example.com."))
+	r.Equal(servers, s.parentZones.get("ent.example.com."))
+	n := len(zones.Queries())
+	_, err = s.parentServers(ctx, "y.ent.example.com.")
+	r.NoError(err)
+	r.Len(zones.Queries(), n)
+
+	// The parent server of x.ent.example.com. is authoritative for it,
+	// there is no referral to compare.
+	res = new(Result)
+	s.scanDelegation(ctx, res, "x.ent.example.com.", servers)
+	r.Nil(res.NsMismatch)
+	r.True(res.ParentAuth)
+	r.Empty(res.Errs)
+}
+
+func Test_scanner_scanDelegation_parentAuth(t *testing.T) {
+	r := require.New(t)
+	zones := testZones(t)
+
+	// The stand-in of example.com. is also the server of its parent zone.
+	// Its answers have the child side NS set in the authority section.
+	example := []netip.Addr{netip.MustParseAddr("127.0.0.3")}
+	s := &scanner{authUDP: zones, authTCP: zones, authPort: 53, parentZones: newZoneCache()}
+	s.parentZones.store("com.", example, parentCacheTtl)
+
+	res := new(Result)
+	s.scanDelegation(context.Background(), res, "example.com.", example)
+	r.Empty(res.ParentNss)
+	r.Equal([]string{"ns1.example.com.", "ns2.example.com."}, res.ChildNss)
+	r.Nil(res.NsMismatch)
+	r.True(res.ParentAuth)
+	r.Empty(res.Errs)
+}
+
+func Test_scanner_scan_brokenDelegation(t *testing.T) {
+	r := require.New(t)
+
+	// The upstream fails to resolve example.com., but its parent zone still
+	// has the delegation, and the referral leads to the child zone servers.
+	com := &authStandIn{zone: "com.", rrs: parseZone(t, `
+example.com.         3600 NS   ns1.example.com.
+ns1.example.com.     3600 A    127.0.0.3
+`)}
+	example := &authStandIn{zone: "example.com.", rrs: parseZone(t, `
+example.com.         3600 NS   ns1.example.com.
+example.com.         3600 NS   ns2.example.com.
+`)}
+	zones := standIns(map[string]*authStandIn{"127.0.0.2": com, "127.0.0.3": example})
+	servfail := &dnsClient.Fake{Handler: func(q *dns.Msg, _ netip.AddrPort) (*dns.Msg, error) {
+		return new(dns.Msg).SetRcode(q, dns.RcodeServerFailure), nil
+	}}
+	s := &scanner{
+		upstreams:       testPool(servfail),
+		authUDP:         zones,
+		authTCP:         zones,
+		authPort:        53,
+		targets:         scanTargets{ns: true},
+		checkDelegation: true,
+		parentZones:     newZoneCache(),
+	}
+	s.parentZones.store("com.", []netip.Addr{netip.MustParseAddr("127.0.0.2")}, parentCacheTtl)
+
+	res := s.scan(context.Background(), "example.com.")
+	r.Len(res.Errs, 1)
+	r.Contains(res.Errs[0], "failed to lookup ns")
+	r.Equal([]string{"ns1.example.com."}, res.ParentNss)
+	r.Equal([]string{"ns1.example.com.", "ns2.example.com."}, res.ChildNss)
+	r.NotNil(res.NsMismatch)
+	r.True(*res.NsMismatch)
+}
@@ -0,0 +1,84 @@
+package scan
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// parseEcsList parses subnets of EDNS Client Subnet (RFC 7871) options.
+func parseEcsList(ss []string) ([]*dns.EDNS0_SUBNET, error) {
+	var ecss []*dns.EDNS0_SUBNET
+	for _, s := range ss {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ecs subnet %s, %w", s, err)
+		}
+		prefix = prefix.Masked()
+		ecs := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			SourceNetmask: uint8(prefix.Bits()),
+			Address:       net.IP(prefix.Addr().AsSlice()),
+		}
+		if prefix.Addr().Is4() {
+			ecs.Family = 1
+		} else {
+			ecs.Family = 2
+		}
+		ecss = append(ecss, ecs)
+	}
+	return ecss, nil
+}
+
+// withEcsList returns a scanner for each of ecss. If ecss is empty,
+// it returns s itself.
+func (s *scanner) withEcsList(ecss []*dns.EDNS0_SUBNET) []*scanner {
+	if len(ecss) == 0 {
+		return []*scanner{s}
+	}
+	scanners := make([]*scanner, 0, len(ecss))
+	for _, ecs := range ecss {
+		scanners = append(scanners, s.withEcs(ecs))
+	}
+	return scanners
+}
+
+// withEcs returns a copy of s that attaches ecs to its queries. The copy
+// has its own ns cache, because addresses depend on the subnet.
+func (s *scanner) withEcs(ecs *dns.EDNS0_SUBNET) *scanner {
+	sc := *s
+	sc.ecs = ecs
+	sc.ecsName = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+	if s.nsCache != nil {
+		sc.nsCache = newNsCache(s.nsCache.size, s.nsCache.timeout)
+	}
+	return &sc
+}
+
+// recordEcsScope records the scope prefix length of the ecs option in resp.
+func (st *scanStats) recordEcsScope(resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			st.maxEcsScope(int32(ecs.SourceScope))
+			return
+		}
+	}
+}
+
+func (s *scanner) resultKey(fqdn string) string {
+	return resumeKey(fqdn, s.ecsName)
+}
+
+// resumeKey is the key of a result in the output file.
+func resumeKey(fqdn, ecs string) string {
+	if len(ecs) == 0 {
+		return fqdn
+	}
+	return fqdn + " " + ecs
+}
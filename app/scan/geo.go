@@ -0,0 +1,176 @@
+package scan
+
+import (
+	"cmp"
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/geoip2-golang"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+)
+
+// geoDB looks up countries of addresses. It is a *geoip2.Reader.
+type geoDB interface {
+	Country(ip net.IP) (*geoip2.Country, error)
+}
+
+// asnDB looks up ASNs of addresses. It is a *geoip2.Reader.
+type asnDB interface {
+	ASN(ip net.IP) (*geoip2.ASN, error)
+}
+
+// HostDetail is a host and its addresses.
+type HostDetail struct {
+	Name  string       `json:"name"`
+	Addrs []AddrDetail `json:"addrs,omitempty"`
+}
+
+// AddrDetail is an address with all its enrichment.
+type AddrDetail struct {
+	Addr              string `json:"addr"`
+	Country           string `json:"country,omitempty"`
+	Continent         string `json:"continent,omitempty"`
+	RegisteredCountry string `json:"registered_country,omitempty"`
+	Asn               uint   `json:"asn,omitempty"`    // Only available with --asn.
+	Org               string `json:"org,omitempty"`    // Only available with --asn.
+	Source            string `json:"source,omitempty"` // Only available with --glue. "glue" or "lookup".
+}
+
+const (
+	addrSourceGlue   = "glue"
+	addrSourceLookup = "lookup"
+)
+
+type AddrAsn struct {
+	Addr string `json:"addr"`
+	Asn  uint   `json:"asn,omitempty"`
+	Org  string `json:"org,omitempty"`
+}
+
+// locate returns deduplicated and sorted addresses and their ISO country codes.
+func (s *scanner) locate(addrs []netip.Addr) (addrStrs, locCodes []string) {
+	addrsM := make(map[netip.Addr]struct{})
+	locCodesM := make(map[string]struct{})
+	for _, addr := range addrs {
+		if _, dup := addrsM[addr]; dup {
+			continue
+		}
+		addrsM[addr] = struct{}{}
+		addrStrs = append(addrStrs, addr.String())
+
+		if s.geoReader == nil {
+			continue
+		}
+		c, err := s.geoReader.Country(addr.AsSlice())
+		if err != nil {
+			logger.Error("geoip database read err", zap.Error(err)) // Fatal error maybe?
+			continue
+		}
+		if s := c.Country.IsoCode; len(s) > 0 {
+			locCodesM[s] = struct{}{}
+		}
+	}
+	locCodes = key(locCodesM)
+
+	// Just make result looks better.
+	slices.Sort(addrStrs)
+	slices.Sort(locCodes)
+	return addrStrs, locCodes
+}
+
+// lookupAsns looks up ASN and organization of all addresses in r.
+func (s *scanner) lookupAsns(r *Result) {
+	addrsM := make(map[string]struct{})
+	for _, addrs := range [...][]string{r.NsAddrs, r.MxAddrs, r.ApexAddrs, r.WwwAddrs} {
+		for _, a := range addrs {
+			addrsM[a] = struct{}{}
+		}
+	}
+
+	for a := range addrsM {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			continue
+		}
+		asn, err := s.asnReader.ASN(addr.AsSlice())
+		if err != nil {
+			logger.Error("asn database read err", zap.Error(err))
+			continue
+		}
+		r.Asns = append(r.Asns, AddrAsn{
+			Addr: a,
+			Asn:  asn.AutonomousSystemNumber,
+			Org:  asn.AutonomousSystemOrganization,
+		})
+	}
+	slices.SortFunc(r.Asns, func(a, b AddrAsn) int {
+		return cmp.Compare(a.Addr, b.Addr)
+	})
+}
+
+// hostDetails returns details of hosts in the same order.
+func (s *scanner) hostDetails(hosts []string, hostAddrs map[string][]netip.Addr) []HostDetail {
+	d := make([]HostDetail, 0, len(hosts))
+	for _, h := range hosts {
+		d = append(d, HostDetail{Name: h, Addrs: s.addrDetails(hostAddrs[h])})
+	}
+	return d
+}
+
+// addrDetails returns deduplicated details of addrs, sorted by address.
+func (s *scanner) addrDetails(addrs []netip.Addr) []AddrDetail {
+	addrsM := make(map[netip.Addr]struct{})
+	var d []AddrDetail
+	for _, addr := range addrs {
+		if _, dup := addrsM[addr]; dup {
+			continue
+		}
+		addrsM[addr] = struct{}{}
+		d = append(d, s.addrDetail(addr))
+	}
+	slices.SortFunc(d, func(a, b AddrDetail) int {
+		return cmp.Compare(a.Addr, b.Addr)
+	})
+	return d
+}
+
+func (s *scanner) addrDetail(addr netip.Addr) AddrDetail {
+	d := AddrDetail{Addr: addr.String()}
+	if s.geoReader != nil {
+		c, err := s.geoReader.Country(addr.AsSlice())
+		if err != nil {
+			logger.Error("geoip database read err", zap.Error(err))
+		} else {
+			d.Country = c.Country.IsoCode
+			d.Continent = c.Continent.Code
+			d.RegisteredCountry = c.RegisteredCountry.IsoCode
+		}
+	}
+	if s.asnReader != nil {
+		asn, err := s.asnReader.ASN(addr.AsSlice())
+		if err != nil {
+			logger.Error("asn database read err", zap.Error(err))
+		} else {
+			d.Asn = asn.AutonomousSystemNumber
+			d.Org = asn.AutonomousSystemOrganization
+		}
+	}
+	return d
+}
+
+// markAddrSource sets the source of addresses in hosts.
+// glue is host -> addresses from glue.
+func markAddrSource(hosts []HostDetail, glue map[string][]netip.Addr) {
+	for _, h := range hosts {
+		for i, a := range h.Addrs {
+			h.Addrs[i].Source = addrSourceLookup
+			for _, g := range glue[h.Name] {
+				if g.String() == a.Addr {
+					h.Addrs[i].Source = addrSourceGlue
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package scan
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGeo is a geoip and asn database of fixed records. Addresses that are
+// not in it have empty records.
+type fakeGeo struct {
+	countries map[string]string // addr -> iso code
+	asns      map[string]uint   // addr -> asn
+}
+
+func (g *fakeGeo) Country(ip net.IP) (*geoip2.Country, error) {
+	c := new(geoip2.Country)
+	if code, ok := g.countries[ip.String()]; ok {
+		c.Country.IsoCode = code
+		c.RegisteredCountry.IsoCode = code
+		c.Continent.Code = "NA"
+	}
+	return c, nil
+}
+
+func (g *fakeGeo) ASN(ip net.IP) (*geoip2.ASN, error) {
+	a := new(geoip2.ASN)
+	if asn, ok := g.asns[ip.String()]; ok {
+		a.AutonomousSystemNumber = asn
+		a.AutonomousSystemOrganization = "org-" + ip.String()
+	}
+	return a, nil
+}
+
+func Test_scanner_asn(t *testing.T) {
+	r := require.New(t)
+
+	geo := &fakeGeo{asns: map[string]uint{
+		"192.0.2.53":   64500,
+		"2001:db8::53": 64501,
+		"192.0.2.1":    64502,
+	}}
+	s := &scanner{
+		upstreams: testPool(fakeRecursor(t, testRecursorZone, false)),
+		asnReader: geo,
+		targets:   scanTargets{ns: true, apex: true},
+	}
+
+	// All addresses are looked up once. Addresses without records have no asn.
+	res := s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal([]AddrAsn{
+		{Addr: "192.0.2.1", Asn: 64502, Org: "org-192.0.2.1"},
+		{Addr: "192.0.2.53", Asn: 64500, Org: "org-192.0.2.53"},
+		{Addr: "198.51.100.53"},
+		{Addr: "2001:db8::53", Asn: 64501, Org: "org-2001:db8::53"},
+	}, res.Asns)
+
+	// Asns are in address details instead.
+	s.detail = true
+	res = s.scan(context.Background(), "example.com.")
+	r.Empty(res.Asns)
+	r.Equal([]AddrDetail{{Addr: "192.0.2.1", Asn: 64502, Org: "org-192.0.2.1"}}, res.ApexDetail)
+	r.Equal([]AddrDetail{{Addr: "192.0.2.53", Asn: 64500, Org: "org-192.0.2.53"}}, res.NsDetail[0].Addrs)
+}
+
+func Test_scanner_detail(t *testing.T) {
+	r := require.New(t)
+
+	s := &scanner{
+		upstreams: testPool(fakeRecursor(t, testRecursorZone, false)),
+		geoReader: &fakeGeo{countries: map[string]string{"192.0.2.53": "US", "192.0.2.2": "DE", "192.0.2.25": "JP"}},
+		targets:   scanTargets{ns: true, apex: true, www: true, mx: true},
+		detail:    true,
+	}
+
+	// Hosts keep their order, addresses are sorted. Flat fields are empty.
+	res := s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Empty(res.Nss)
+	r.Empty(res.NsAddrs)
+	r.Empty(res.LocCodes)
+	r.Empty(res.Mxs)
+	r.Empty(res.ApexAddrs)
+	r.Equal([]HostDetail{
+		{Name: "ns1.example.com.", Addrs: []AddrDetail{{Addr: "192.0.2.53", Country: "US", Continent: "NA", RegisteredCountry: "US"}}},
+		{Name: "ns2.example.net.", Addrs: []AddrDetail{{Addr: "198.51.100.53"}, {Addr: "2001:db8::53"}}},
+	}, res.NsDetail)
+	r.Equal([]HostDetail{
+		{Name: "mx1.example.com.", Addrs: []AddrDetail{{Addr: "192.0.2.25", Country: "JP", Continent: "NA", RegisteredCountry: "JP"}}},
+		{Name: "mx2.example.com.", Addrs: []AddrDetail{{Addr: "192.0.2.26"}}},
+	}, res.MxDetail)
+	r.Equal([]AddrDetail{{Addr: "192.0.2.1"}}, res.ApexDetail)
+	r.Equal([]AddrDetail{{Addr: "192.0.2.2", Country: "DE", Continent: "NA", RegisteredCountry: "DE"}}, res.WwwDetail)
+}
@@ -0,0 +1,391 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	modeRecursive = "recursive"
+	modeIterative = "iterative"
+)
+
+var (
+	errNoServer       = errors.New("no server available")
+	errLameReferral   = errors.New("lame referral")
+	errTooManyHops    = errors.New("too many referrals or cname hops")
+	errNoRootHints    = errors.New("no address in root hints")
+	errResolveTooDeep = errors.New("name server resolution too deep")
+)
+
+const (
+	maxReferrals      = 16
+	maxCnameHops      = 8
+	maxNsResolveDepth = 4
+	maxServerTries    = 3
+)
+
+// Builtin root hints, from https://www.internic.net/domain/named.root
+const defaultRootHints = `
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      3600000      AAAA  2801:1b8:10::b
+.                        3600000      NS    C.ROOT-SERVERS.NET.
+C.ROOT-SERVERS.NET.      3600000      A     192.33.4.12
+C.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2::c
+.                        3600000      NS    D.ROOT-SERVERS.NET.
+D.ROOT-SERVERS.NET.      3600000      A     199.7.91.13
+D.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2d::d
+.                        3600000      NS    E.ROOT-SERVERS.NET.
+E.ROOT-SERVERS.NET.      3600000      A     192.203.230.10
+E.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:a8::e
+.                        3600000      NS    F.ROOT-SERVERS.NET.
+F.ROOT-SERVERS.NET.      3600000      A     192.5.5.241
+F.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2f::f
+.                        3600000      NS    G.ROOT-SERVERS.NET.
+G.ROOT-SERVERS.NET.      3600000      A     192.112.36.4
+G.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:12::d0d
+.                        3600000      NS    H.ROOT-SERVERS.NET.
+H.ROOT-SERVERS.NET.      3600000      A     198.97.190.53
+H.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:1::53
+.                        3600000      NS    I.ROOT-SERVERS.NET.
+I.ROOT-SERVERS.NET.      3600000      A     192.36.148.17
+I.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fe::53
+.                        3600000      NS    J.ROOT-SERVERS.NET.
+J.ROOT-SERVERS.NET.      3600000      A     192.58.128.30
+J.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:c27::2:30
+.                        3600000      NS    K.ROOT-SERVERS.NET.
+K.ROOT-SERVERS.NET.      3600000      A     193.0.14.129
+K.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fd::1
+.                        3600000      NS    L.ROOT-SERVERS.NET.
+L.ROOT-SERVERS.NET.      3600000      A     199.7.83.42
+L.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:9f::42
+.                        3600000      NS    M.ROOT-SERVERS.NET.
+M.ROOT-SERVERS.NET.      3600000      A     202.12.27.33
+M.ROOT-SERVERS.NET.      3600000      AAAA  2001:dc3::35
+`
+
+// loadRootHints loads root server addresses from a root hints file.
+// If fp is empty, builtin root hints will be used.
+func loadRootHints(fp string) ([]netip.Addr, error) {
+	if len(fp) == 0 {
+		return parseRootHints(strings.NewReader(defaultRootHints))
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRootHints(f)
+}
+
+// parseRootHints parses root hints in zone file format. Addresses of
+// root name servers (the NS records of ".") are returned.
+func parseRootHints(r io.Reader) ([]netip.Addr, error) {
+	rootNss := make(map[string]struct{})
+	hostAddrs := make(map[string][]netip.Addr)
+	zp := dns.NewZoneParser(r, ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		switch v := rr.(type) {
+		case *dns.NS:
+			if name == "." {
+				rootNss[strings.ToLower(v.Ns)] = struct{}{}
+			}
+		case *dns.A, *dns.AAAA:
+			if a, ok := rrAddr(v); ok {
+				hostAddrs[name] = append(hostAddrs[name], a)
+			}
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	for ns := range rootNss {
+		addrs = append(addrs, hostAddrs[ns]...)
+	}
+	if len(addrs) == 0 {
+		return nil, errNoRootHints
+	}
+	return addrs, nil
+}
+
+// iterResolver resolves names by walking the delegation from root servers.
+type iterResolver struct {
+	roots []netip.Addr
+	port  uint16 // Port of authoritative servers. Normally 53.
+
+	exchange exchangeFunc
+	zones    *zoneCache
+}
+
+// exchangeFunc sends a non-recursive query to an authoritative server.
+type exchangeFunc func(ctx context.Context, q *dns.Msg, server netip.AddrPort) (*dns.Msg, error)
+
+func newIterResolver(roots []netip.Addr, port uint16, exchange exchangeFunc) *iterResolver {
+	return &iterResolver{
+		roots:    roots,
+		port:     port,
+		exchange: exchange,
+		zones:    newZoneCache(),
+	}
+}
+
+// resolve resolves name with type qt. The returned msg is the final response
+// from the authoritative server. CNAMEs that were followed are prepended to
+// its answer section.
+func (r *iterResolver) resolve(ctx context.Context, name string, qt uint16) (*dns.Msg, error) {
+	return r.resolveDepth(ctx, name, qt, 0)
+}
+
+func (r *iterResolver) resolveDepth(ctx context.Context, name string, qt uint16, depth int) (*dns.Msg, error) {
+	if depth > maxNsResolveDepth {
+		return nil, errResolveTooDeep
+	}
+
+	var cnames []dns.RR
+	qName := name
+	for hop := 0; hop <= maxCnameHops; hop++ {
+		resp, err := r.lookup(ctx, qName, qt, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		target := ""
+		if resp.Rcode == dns.RcodeSuccess && qt != dns.TypeCNAME && !hasAnswer(resp, qName, qt) {
+			target = cnameTarget(resp, qName)
+			if len(target) > 0 && hasAnswer(resp, target, qt) {
+				target = "" // The whole chain is already in the answer.
+			}
+		}
+		if len(target) == 0 {
+			if len(cnames) > 0 {
+				resp = resp.Copy()
+				resp.Answer = append(cnames, resp.Answer...)
+			}
+			return resp, nil
+		}
+		cnames = append(cnames, resp.Answer...)
+		qName = target
+	}
+	return nil, errTooManyHops
+}
+
+// lookup follows referrals until a response that is not a referral is received.
+func (r *iterResolver) lookup(ctx context.Context, name string, qt uint16, depth int) (*dns.Msg, error) {
+	zone, servers := r.zones.closest(name)
+	if len(servers) == 0 {
+		zone, servers = ".", r.roots
+	}
+	for i := 0; i < maxReferrals; i++ {
+		resp, err := queryServers(ctx, r.exchange, servers, r.port, name, qt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query zone %s, %w", zone, err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 || resp.Authoritative {
+			return resp, nil
+		}
+
+		child, nss, ttl := referral(resp, zone, name)
+		if len(child) == 0 {
+			if len(nss) > 0 {
+				return nil, errLameReferral
+			}
+			return resp, nil // NODATA
+		}
+
+		// Only trust glue of name servers under zone. Others may be
+		// injected by servers of zone, resolve them separately.
+		addrs := glueAddrs(resp, zone, nss)
+		if len(addrs) == 0 {
+			addrs = r.resolveNss(ctx, nss, depth)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("failed to resolve name servers of zone %s, %w", child, errNoServer)
+		}
+		r.zones.store(child, addrs, ttl)
+		zone, servers = child, addrs
+	}
+	return nil, errTooManyHops
+}
+
+// queryServers sends a non-recursive query to servers in random order (IPv4 first)
+// until one of them returns a response that is not SERVFAIL or REFUSED.
+func queryServers(ctx context.Context, exchange exchangeFunc, servers []netip.Addr, port uint16, name string, qt uint16) (*dns.Msg, error) {
+	shuffled := make([]netip.Addr, len(servers))
+	copy(shuffled, servers)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	sortV4First(shuffled)
+
+	var lastErr error = errNoServer
+	for i, addr := range shuffled {
+		if i >= maxServerTries {
+			break
+		}
+		q := new(dns.Msg)
+		q.SetQuestion(name, qt)
+		q.RecursionDesired = false
+		q.SetEdns0(1200, false)
+		resp, err := exchange(ctx, q, netip.AddrPortFrom(addr, port))
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			lastErr = err
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("bad rcode %d from %s", resp.Rcode, addr)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// resolveNss resolves addresses of name servers that have no glue.
+// It returns on the first name server that has addresses.
+func (r *iterResolver) resolveNss(ctx context.Context, nss []string, depth int) []netip.Addr {
+	for _, ns := range nss {
+		var addrs []netip.Addr
+		for _, qt := range [...]uint16{dns.TypeA, dns.TypeAAAA} {
+			resp, err := r.resolveDepth(ctx, ns, qt, depth+1)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, answerAddrs(resp)...)
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// referral returns the delegated child zone and its name servers if resp
+// is a referral from zone towards name. If the authority section only
+// contains NS records that are not closer to name (a lame referral), child
+// will be empty but nss will not.
+func referral(resp *dns.Msg, zone, name string) (child string, nss []string, ttl uint32) {
+	name = strings.ToLower(name)
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if dns.IsSubDomain(owner, name) && dns.IsSubDomain(zone, owner) && dns.CountLabel(owner) > dns.CountLabel(zone) {
+			child = owner
+			break
+		}
+	}
+
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok || (len(child) > 0 && !strings.EqualFold(ns.Hdr.Name, child)) {
+			continue
+		}
+		nss = append(nss, ns.Ns)
+		if ttl == 0 || ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+	}
+	return child, nss, ttl
+}
+
+// glueAddrs returns addresses of nss from the additional section without
+// duplicates. Name servers that are not under zone are ignored.
+func glueAddrs(resp *dns.Msg, zone string, nss []string) []netip.Addr {
+	m := make(map[string]struct{}, len(nss))
+	for _, ns := range nss {
+		ns = strings.ToLower(ns)
+		if dns.IsSubDomain(zone, ns) {
+			m[ns] = struct{}{}
+		}
+	}
+	var addrs []netip.Addr
+	for _, rr := range resp.Extra {
+		if _, ok := m[strings.ToLower(rr.Header().Name)]; !ok {
+			continue
+		}
+		if a, ok := rrAddr(rr); ok && !slices.Contains(addrs, a) {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+func hasAnswer(resp *dns.Msg, name string, qt uint16) bool {
+	for _, rr := range resp.Answer {
+		h := rr.Header()
+		if h.Rrtype == qt && strings.EqualFold(h.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cnameTarget returns the end of the cname chain of name in the answer section.
+func cnameTarget(resp *dns.Msg, name string) string {
+	target := ""
+	for i := 0; i < maxCnameHops; i++ {
+		next := ""
+		for _, rr := range resp.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+				next = c.Target
+				break
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		target, name = next, next
+	}
+	return target
+}
+
+func answerAddrs(resp *dns.Msg) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range resp.Answer {
+		if a, ok := rrAddr(rr); ok {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+func rrAddr(rr dns.RR) (netip.Addr, bool) {
+	switch v := rr.(type) {
+	case *dns.A:
+		a, ok := netip.AddrFromSlice(v.A)
+		return a.Unmap(), ok
+	case *dns.AAAA:
+		return netip.AddrFromSlice(v.AAAA)
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+func sortV4First(s []netip.Addr) {
+	i := 0
+	for j, a := range s {
+		if a.Is4() {
+			s[i], s[j] = s[j], s[i]
+			i++
+		}
+	}
+}
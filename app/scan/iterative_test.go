@@ -0,0 +1,300 @@
+package scan
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dnsClient "github.com/IrineSistiana/nsloc/pkg/dns_client"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// authStandIn is a minimal authoritative server that serves records from zone
+// file text. Records that are not in its zone are returned as a referral.
+type authStandIn struct {
+	zone string
+	rrs  []dns.RR
+}
+
+func (a *authStandIn) answer(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	question := q.Question[0]
+
+	// Referral to a child zone.
+	for _, rr := range a.rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeNS && h.Name != a.zone && dns.IsSubDomain(h.Name, question.Name) {
+			for _, rr := range a.rrs {
+				if rr.Header().Name == h.Name && rr.Header().Rrtype == dns.TypeNS {
+					r.Ns = append(r.Ns, rr)
+					for _, glue := range a.rrs {
+						if glue.Header().Name == rr.(*dns.NS).Ns && glue.Header().Rrtype != dns.TypeNS {
+							r.Extra = append(r.Extra, glue)
+						}
+					}
+				}
+			}
+			return r
+		}
+	}
+
+	r.Authoritative = true
+	for _, rr := range a.rrs {
+		h := rr.Header()
+		if strings.EqualFold(h.Name, question.Name) && (h.Rrtype == question.Qtype || h.Rrtype == dns.TypeCNAME) {
+			r.Answer = append(r.Answer, rr)
+		}
+	}
+	if len(r.Answer) > 0 {
+		// The NS set of the zone is in the authority section, like servers
+		// that don't send minimal responses.
+		for _, rr := range a.rrs {
+			if rr.Header().Name == a.zone && rr.Header().Rrtype == dns.TypeNS {
+				r.Ns = append(r.Ns, rr)
+			}
+		}
+	} else {
+		r.Rcode = dns.RcodeNameError
+		for _, rr := range a.rrs {
+			if dns.IsSubDomain(question.Name, rr.Header().Name) {
+				r.Rcode = dns.RcodeSuccess // NODATA or empty non-terminal
+			}
+		}
+	}
+	return r
+}
+
+func (a *authStandIn) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	w.WriteMsg(a.answer(q))
+}
+
+func parseZone(t *testing.T, s string) []dns.RR {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(strings.NewReader(s), ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	require.NoError(t, zp.Err())
+	return rrs
+}
+
+// standIns returns a transport that sends queries to stand-ins by
+// the server address. Servers that are not in standIns refuse queries.
+func standIns(standIns map[string]*authStandIn) *dnsClient.Fake {
+	return &dnsClient.Fake{Handler: func(q *dns.Msg, addr netip.AddrPort) (*dns.Msg, error) {
+		a, ok := standIns[addr.Addr().String()]
+		if !ok {
+			return new(dns.Msg).SetRcode(q, dns.RcodeRefused), nil
+		}
+		return a.answer(q), nil
+	}}
+}
+
+// startStandIns starts UDP servers of handlers on 127.0.0.1, 127.0.0.2, ...
+// with the same port, because the resolver sends queries to all servers
+// on one port. The test is skipped if those addresses can't be bound,
+// e.g. on macOS and the BSDs, where only 127.0.0.1 is configured by default.
+func startStandIns(t *testing.T, handlers ...dns.Handler) uint16 {
+	var port uint16
+	for i, h := range handlers {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, byte(i + 1)}), port)
+		c, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+		if err != nil && i > 0 {
+			t.Skipf("failed to bind stand-in on %s, %s", addr, err)
+		}
+		require.NoError(t, err)
+		if port == 0 {
+			port = c.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		}
+		s := &dns.Server{PacketConn: c, Handler: h}
+		go s.ActivateAndServe()
+		t.Cleanup(func() { s.Shutdown() })
+	}
+	return port
+}
+
+const testRootHints = `
+.                    3600000 NS A.ROOT-SERVERS.TEST.
+A.ROOT-SERVERS.TEST. 3600000 A  127.0.0.1
+`
+
+// testZones returns stand-ins of root, com. and example.com. on 127.0.0.1,
+// 127.0.0.2 and 127.0.0.3. The NS set of example.com. in com. is different
+// from the one in example.com.
+func testZones(t *testing.T) *dnsClient.Fake {
+	root := &authStandIn{zone: ".", rrs: parseZone(t, `
+com.                 3600 NS   a.gtld.test.
+a.gtld.test.         3600 A    127.0.0.2
+`)}
+	com := &authStandIn{zone: "com.", rrs: parseZone(t, `
+com.                 3600 NS   a.gtld.test.
+example.com.         3600 NS   ns1.example.com.
+example.com.         3600 NS   ns.example-dns.com.
+ns1.example.com.     3600 A    127.0.0.3
+ns.example-dns.com.  3600 A    127.0.0.3
+`)}
+	example := &authStandIn{zone: "example.com.", rrs: parseZone(t, `
+example.com.         3600 NS    ns1.example.com.
+example.com.         3600 NS    ns2.example.com.
+ns1.example.com.     3600 A     127.0.0.3
+ns2.example.com.     3600 AAAA  ::1
+www.example.com.     3600 CNAME cdn.example.com.
+cdn.example.com.     3600 CNAME web.example.com.
+web.example.com.     3600 A     192.0.2.1
+x.ent.example.com.   3600 A     192.0.2.2
+`)}
+	return standIns(map[string]*authStandIn{
+		"127.0.0.1": root,
+		"127.0.0.2": com,
+		"127.0.0.3": example,
+	})
+}
+
+func Test_iterResolver(t *testing.T) {
+	r := require.New(t)
+	zones := testZones(t)
+
+	roots, err := parseRootHints(strings.NewReader(testRootHints))
+	r.NoError(err)
+	r.Equal([]netip.Addr{netip.MustParseAddr("127.0.0.1")}, roots)
+
+	resolver := newIterResolver(roots, 53, func(ctx context.Context, q *dns.Msg, server netip.AddrPort) (*dns.Msg, error) {
+		return zones.Exchanger(server).Exchange(ctx, q)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	resp, err := resolver.resolve(ctx, "example.com.", dns.TypeNS)
+	r.NoError(err)
+	r.True(resp.Authoritative)
+	r.Len(resp.Answer, 2)
+
+	resp, err = resolver.resolve(ctx, "www.example.com.", dns.TypeA)
+	r.NoError(err)
+	r.Len(resp.Answer, 3)
+	r.Equal([]netip.Addr{netip.MustParseAddr("192.0.2.1")}, answerAddrs(resp))
+
+	resp, err = resolver.resolve(ctx, "nx.example.com.", dns.TypeA)
+	r.NoError(err)
+	r.Equal(dns.RcodeNameError, resp.Rcode)
+
+	zone, servers := resolver.zones.closest("foo.example.com.")
+	r.Equal("example.com.", zone)
+	r.Equal([]netip.Addr{netip.MustParseAddr("127.0.0.3")}, servers)
+
+	// Names are case-insensitive, e.g. cname targets.
+	zone, servers = resolver.zones.closest("Foo.EXAMPLE.com.")
+	r.Equal("example.com.", zone)
+	r.Len(servers, 1)
+	n := len(zones.Queries())
+	resp, err = resolver.resolve(ctx, "WEB.Example.COM.", dns.TypeA)
+	r.NoError(err)
+	r.Equal([]netip.Addr{netip.MustParseAddr("192.0.2.1")}, answerAddrs(resp))
+	r.Len(zones.Queries(), n+1)
+}
+
+func Test_iterResolver_udp(t *testing.T) {
+	r := require.New(t)
+
+	root := &authStandIn{zone: ".", rrs: parseZone(t, `
+com.                 3600 NS   a.gtld.test.
+a.gtld.test.         3600 A    127.0.0.2
+`)}
+	com := &authStandIn{zone: "com.", rrs: parseZone(t, `
+example.com.         3600 NS   ns1.example.com.
+ns1.example.com.     3600 A    127.0.0.3
+`)}
+	example := &authStandIn{zone: "example.com.", rrs: parseZone(t, `
+example.com.         3600 NS   ns1.example.com.
+ns1.example.com.     3600 A    127.0.0.3
+www.example.com.     3600 A    192.0.2.1
+`)}
+	port := startStandIns(t, root, com, example)
+
+	// Stand-ins are configured via a custom root hints file.
+	hintsFp := filepath.Join(t.TempDir(), "root.hints")
+	r.NoError(os.WriteFile(hintsFp, []byte(testRootHints), 0644))
+	roots, err := loadRootHints(hintsFp)
+	r.NoError(err)
+	r.Equal([]netip.Addr{netip.MustParseAddr("127.0.0.1")}, roots)
+	uc, err := net.ListenUDP("udp", nil)
+	r.NoError(err)
+	dc := dnsClient.New(uc)
+	defer dc.Close()
+	resolver := newIterResolver(roots, port, func(ctx context.Context, q *dns.Msg, server netip.AddrPort) (*dns.Msg, error) {
+		q.Id = dc.NextQid()
+		return dc.Query(ctx, q, server)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	resp, err := resolver.resolve(ctx, "www.example.com.", dns.TypeA)
+	r.NoError(err)
+	r.True(resp.Authoritative)
+	r.Equal([]netip.Addr{netip.MustParseAddr("192.0.2.1")}, answerAddrs(resp))
+	zone, servers := resolver.zones.closest("www.example.com.")
+	r.Equal("example.com.", zone)
+	r.Equal([]netip.Addr{netip.MustParseAddr("127.0.0.3")}, servers)
+}
+
+func Test_glueAddrs(t *testing.T) {
+	r := require.New(t)
+
+	resp := new(dns.Msg)
+	resp.Extra = parseZone(t, `
+ns1.example.com.  3600 A 127.0.0.3
+ns.example.net.   3600 A 192.0.2.53
+`)
+	nss := []string{"NS1.example.com.", "ns.example.net."}
+	r.Equal([]netip.Addr{netip.MustParseAddr("127.0.0.3")}, glueAddrs(resp, "com.", nss))
+	r.Len(glueAddrs(resp, ".", nss), 2)
+	r.Empty(glueAddrs(resp, "org.", nss))
+}
+
+func Test_iterResolver_outOfZoneGlue(t *testing.T) {
+	r := require.New(t)
+
+	root := &authStandIn{zone: ".", rrs: parseZone(t, `
+com.                 3600 NS   a.gtld.test.
+a.gtld.test.         3600 A    127.0.0.2
+net.                 3600 NS   a.nic.test.
+a.nic.test.          3600 A    127.0.0.4
+`)}
+	// com. returns a forged address of a name server that is not under com.
+	com := &authStandIn{zone: "com.", rrs: parseZone(t, `
+example.com.         3600 NS   ns.example.net.
+ns.example.net.      3600 A    127.0.0.66
+`)}
+	nic := &authStandIn{zone: "net.", rrs: parseZone(t, `
+ns.example.net.      3600 A    127.0.0.3
+`)}
+	example := &authStandIn{zone: "example.com.", rrs: parseZone(t, `
+example.com.         3600 A    192.0.2.1
+`)}
+	zones := standIns(map[string]*authStandIn{
+		"127.0.0.1": root,
+		"127.0.0.2": com,
+		"127.0.0.3": example,
+		"127.0.0.4": nic,
+	})
+
+	roots, err := parseRootHints(strings.NewReader(testRootHints))
+	r.NoError(err)
+	resolver := newIterResolver(roots, 53, func(ctx context.Context, q *dns.Msg, server netip.AddrPort) (*dns.Msg, error) {
+		return zones.Exchanger(server).Exchange(ctx, q)
+	})
+	resp, err := resolver.resolve(context.Background(), "example.com.", dns.TypeA)
+	r.NoError(err)
+	r.Equal([]netip.Addr{netip.MustParseAddr("192.0.2.1")}, answerAddrs(resp))
+	for _, q := range zones.Queries() {
+		r.NotEqual("127.0.0.66", q.Addr.Addr().String())
+	}
+}
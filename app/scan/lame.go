@@ -0,0 +1,139 @@
+package scan
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// Status of a name server in NsCheck.
+const (
+	nsStatusOk             = "ok"
+	nsStatusSerialMismatch = "serial_mismatch" // Authoritative, but the serial differs from the others.
+	nsStatusNotAuth        = "not_auth"        // Answered without AA bit.
+	nsStatusNoSoa          = "no_soa"          // Authoritative, but no SOA of the domain. E.g. the server is for the parent zone.
+	nsStatusRefused        = "refused"
+	nsStatusBadRcode       = "bad_rcode"
+	nsStatusTimeout        = "timeout"
+	nsStatusError          = "error"
+	nsStatusSkipped        = "skipped" // Not checked, the scan of the domain was canceled or rate limited.
+)
+
+type NsCheck struct {
+	Ns     string `json:"ns"`
+	Addr   string `json:"addr"`
+	Status string `json:"status"`
+	Rcode  int    `json:"rcode,omitempty"`
+	Serial uint32 `json:"serial,omitempty"`
+}
+
+// scanLame sends a SOA query of fqdn to every name server address and
+// checks whether the server answers authoritatively.
+func (s *scanner) scanLame(ctx context.Context, r *Result, fqdn string, nsAddrs map[string][]netip.Addr) {
+	m := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	for ns, addrs := range nsAddrs {
+		for _, addr := range addrs {
+			ns, addr := ns, addr
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c := s.checkNs(ctx, fqdn, ns, addr)
+				m.Lock()
+				defer m.Unlock()
+				r.NsChecks = append(r.NsChecks, c)
+			}()
+		}
+	}
+	wg.Wait()
+
+	// Servers that have a serial different from the most common one.
+	serialCount := make(map[uint32]int)
+	for _, c := range r.NsChecks {
+		if c.Status == nsStatusOk {
+			serialCount[c.Serial]++
+		}
+	}
+	var commonSerial uint32
+	for serial, n := range serialCount {
+		if n > serialCount[commonSerial] || (n == serialCount[commonSerial] && serial > commonSerial) {
+			commonSerial = serial
+		}
+	}
+	for i, c := range r.NsChecks {
+		if c.Status == nsStatusOk && c.Serial != commonSerial {
+			r.NsChecks[i].Status = nsStatusSerialMismatch
+			r.SerialMismatch = true
+		}
+	}
+
+	skipped := 0
+	for _, c := range r.NsChecks {
+		switch c.Status {
+		case nsStatusOk, nsStatusSerialMismatch:
+		case nsStatusSkipped:
+			skipped++
+		default:
+			r.Lame = true
+		}
+	}
+	if skipped > 0 {
+		// The result is incomplete. Report it so it can be retried.
+		r.Errs = append(r.Errs, fmt.Sprintf("%d ns checks skipped", skipped))
+	}
+	slices.SortFunc(r.NsChecks, func(a, b NsCheck) int {
+		if c := cmp.Compare(a.Ns, b.Ns); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Addr, b.Addr)
+	})
+}
+
+func (s *scanner) checkNs(ctx context.Context, fqdn, ns string, addr netip.Addr) NsCheck {
+	c := NsCheck{Ns: ns, Addr: addr.String()}
+
+	q := new(dns.Msg)
+	q.SetQuestion(fqdn, dns.TypeSOA)
+	q.RecursionDesired = false
+	q.SetEdns0(1200, false)
+	resp, err := s.exchangeAuth(ctx, q, netip.AddrPortFrom(addr, s.authPort))
+	if err != nil {
+		switch {
+		case ctx.Err() != nil || errors.Is(err, errAuthLimited):
+			// Not a failure of the server.
+			c.Status = nsStatusSkipped
+		case errors.Is(err, context.DeadlineExceeded):
+			c.Status = nsStatusTimeout
+		default:
+			c.Status = nsStatusError
+		}
+		return c
+	}
+
+	c.Rcode = resp.Rcode
+	switch {
+	case resp.Rcode == dns.RcodeRefused:
+		c.Status = nsStatusRefused
+	case resp.Rcode != dns.RcodeSuccess:
+		c.Status = nsStatusBadRcode
+	case !resp.Authoritative:
+		c.Status = nsStatusNotAuth
+	default:
+		c.Status = nsStatusNoSoa
+		for _, rr := range resp.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, fqdn) {
+				c.Status = nsStatusOk
+				c.Serial = soa.Serial
+				break
+			}
+		}
+	}
+	return c
+}
@@ -0,0 +1,169 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	dnsClient "github.com/IrineSistiana/nsloc/pkg/dns_client"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// soaReply returns a handler that answers with rcode, the AA bit and,
+// if serial is not 0, a SOA record of owner.
+func soaReply(rcode int, aa bool, owner string, serial uint32) func(q *dns.Msg) (*dns.Msg, error) {
+	return func(q *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetRcode(q, rcode)
+		r.Authoritative = aa
+		if serial != 0 {
+			rr, err := dns.NewRR(fmt.Sprintf("%s 300 IN SOA ns1.example.com. admin.example.com. %d 7200 3600 1209600 300", owner, serial))
+			if err != nil {
+				return nil, err
+			}
+			r.Answer = append(r.Answer, rr)
+		}
+		return r, nil
+	}
+}
+
+func Test_scanner_checkNs(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    func(q *dns.Msg) (*dns.Msg, error)
+		wantStatus string
+		wantSerial uint32
+	}{
+		{"ok", soaReply(dns.RcodeSuccess, true, "example.com.", 10), nsStatusOk, 10},
+		{"no soa", soaReply(dns.RcodeSuccess, true, "", 0), nsStatusNoSoa, 0},
+		{"soa of parent", soaReply(dns.RcodeSuccess, true, "com.", 10), nsStatusNoSoa, 0},
+		{"not auth", soaReply(dns.RcodeSuccess, false, "example.com.", 10), nsStatusNotAuth, 0},
+		{"refused", soaReply(dns.RcodeRefused, false, "", 0), nsStatusRefused, 0},
+		{"servfail", soaReply(dns.RcodeServerFailure, false, "", 0), nsStatusBadRcode, 0},
+		{"timeout", func(q *dns.Msg) (*dns.Msg, error) { return nil, context.DeadlineExceeded }, nsStatusTimeout, 0},
+		{"error", func(q *dns.Msg) (*dns.Msg, error) { return nil, errors.New("test") }, nsStatusError, 0},
+		{"auth limited", func(q *dns.Msg) (*dns.Msg, error) { return nil, errAuthLimited }, nsStatusSkipped, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &dnsClient.Fake{Handler: func(q *dns.Msg, _ netip.AddrPort) (*dns.Msg, error) {
+				return tt.handler(q)
+			}}
+			s := &scanner{authUDP: tr, authTCP: tr, authPort: 53}
+			c := s.checkNs(context.Background(), "example.com.", "ns1.example.com.", netip.MustParseAddr("192.0.2.53"))
+			require.Equal(t, tt.wantStatus, c.Status)
+			require.Equal(t, tt.wantSerial, c.Serial)
+		})
+	}
+}
+
+func Test_scanner_scanLame(t *testing.T) {
+	r := require.New(t)
+
+	// Two servers have serial 10, one has 9, and two have no SOA.
+	handlers := map[string]func(q *dns.Msg) (*dns.Msg, error){
+		"192.0.2.1": soaReply(dns.RcodeSuccess, true, "example.com.", 10),
+		"192.0.2.2": soaReply(dns.RcodeSuccess, true, "example.com.", 10),
+		"192.0.2.3": soaReply(dns.RcodeSuccess, true, "example.com.", 9),
+		"192.0.2.4": soaReply(dns.RcodeSuccess, true, "", 0),
+		"192.0.2.5": soaReply(dns.RcodeSuccess, true, "", 0),
+	}
+	tr := &dnsClient.Fake{Handler: func(q *dns.Msg, addr netip.AddrPort) (*dns.Msg, error) {
+		return handlers[addr.Addr().String()](q)
+	}}
+	s := &scanner{authUDP: tr, authTCP: tr, authPort: 53}
+	nsAddrs := make(map[string][]netip.Addr)
+	for addr := range handlers {
+		nsAddrs["ns.example.com."] = append(nsAddrs["ns.example.com."], netip.MustParseAddr(addr))
+	}
+
+	res := new(Result)
+	s.scanLame(context.Background(), res, "example.com.", nsAddrs)
+	r.True(res.Lame)
+	r.True(res.SerialMismatch)
+	statuses := make(map[string]string)
+	for _, c := range res.NsChecks {
+		statuses[c.Addr] = c.Status
+	}
+	r.Equal(map[string]string{
+		"192.0.2.1": nsStatusOk,
+		"192.0.2.2": nsStatusOk,
+		"192.0.2.3": nsStatusSerialMismatch,
+		"192.0.2.4": nsStatusNoSoa,
+		"192.0.2.5": nsStatusNoSoa,
+	}, statuses)
+
+	// Servers without SOA are not compared.
+	delete(handlers, "192.0.2.3")
+	nsAddrs["ns.example.com."] = []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.4"), netip.MustParseAddr("192.0.2.5")}
+	res = new(Result)
+	s.scanLame(context.Background(), res, "example.com.", nsAddrs)
+	r.True(res.Lame)
+	r.False(res.SerialMismatch)
+}
+
+func Test_scanner_scanLame_canceled(t *testing.T) {
+	r := require.New(t)
+
+	// Checks that are not done because the scan was canceled are not lame.
+	tr := &dnsClient.Fake{Handler: func(q *dns.Msg, _ netip.AddrPort) (*dns.Msg, error) {
+		return nil, context.Canceled
+	}}
+	s := &scanner{authUDP: tr, authTCP: tr, authPort: 53}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res := new(Result)
+	nsAddrs := map[string][]netip.Addr{"ns.example.com.": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}}
+	s.scanLame(ctx, res, "example.com.", nsAddrs)
+	r.False(res.Lame)
+	r.Len(res.NsChecks, 2)
+	for _, c := range res.NsChecks {
+		r.Equal(nsStatusSkipped, c.Status)
+	}
+	r.Equal([]string{"2 ns checks skipped"}, res.Errs)
+}
+
+func Test_scanner_scan_lame(t *testing.T) {
+	r := require.New(t)
+
+	// Only one of the three name server addresses is authoritative.
+	auth := &dnsClient.Fake{Handler: func(q *dns.Msg, addr netip.AddrPort) (*dns.Msg, error) {
+		if addr.Addr() == netip.MustParseAddr("192.0.2.53") {
+			return soaReply(dns.RcodeSuccess, true, "example.com.", 10)(q)
+		}
+		return soaReply(dns.RcodeRefused, false, "", 0)(q)
+	}}
+	s := &scanner{
+		upstreams: testPool(fakeRecursor(t, testRecursorZone, false)),
+		authUDP:   auth,
+		authTCP:   auth,
+		authPort:  53,
+		targets:   scanTargets{ns: true},
+		checkLame: true,
+		adaptive:  newAdaptiveRate(rate.NewLimiter(1, 1), 100),
+	}
+	res := s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	// REFUSED from lame servers doesn't cut the rate, only upstream queries are observed.
+	r.NotZero(s.adaptive.queries)
+	r.Zero(s.adaptive.failures)
+	r.True(res.Lame)
+	r.False(res.SerialMismatch)
+	r.Equal([]NsCheck{
+		{Ns: "ns1.example.com.", Addr: "192.0.2.53", Status: nsStatusOk, Serial: 10},
+		{Ns: "ns2.example.net.", Addr: "198.51.100.53", Status: nsStatusRefused, Rcode: dns.RcodeRefused},
+		{Ns: "ns2.example.net.", Addr: "2001:db8::53", Status: nsStatusRefused, Rcode: dns.RcodeRefused},
+	}, res.NsChecks)
+
+	// Without --lame, name servers are not queried.
+	n := len(auth.Queries())
+	s.checkLame = false
+	res = s.scan(context.Background(), "example.com.")
+	r.False(res.Lame)
+	r.Empty(res.NsChecks)
+	r.Len(auth.Queries(), n)
+}
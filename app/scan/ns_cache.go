@@ -0,0 +1,186 @@
+package scan
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	maxNsCacheTtl          = time.Hour
+	defaultNegativeTtl     = time.Minute * 5
+	defaultNsCacheEntries  = 1 << 16
+	defaultNsLookupTimeout = time.Second * 30
+)
+
+// nsCache is a lru cache of name server host -> addresses. It is safe for
+// concurrent use. Concurrent lookups of the same key are de-duplicated.
+// Negative results (NXDOMAIN and empty answers) are cached as well.
+type nsCache struct {
+	size    int
+	timeout time.Duration // Timeout of each lookup.
+
+	m  sync.Mutex
+	l  *list.List               // *nsCacheEntry, most recently used first.
+	em map[string]*list.Element // key -> element in l
+
+	sf singleflight.Group
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	shared atomic.Uint64 // Misses that were de-duplicated with other in-flight lookups.
+}
+
+// nsLookupResult is the result of a shared lookup.
+type nsLookupResult struct {
+	addrs []netip.Addr
+	stats *scanStats // Queries of the lookup. Nil if it was answered from the cache.
+}
+
+type nsCacheEntry struct {
+	key    string
+	addrs  []netip.Addr
+	err    error
+	expire time.Time
+}
+
+// addrLookupFunc looks up addresses of host. ttl is the time that the result
+// can be cached. If ttl <= 0, the result won't be cached.
+type addrLookupFunc func(ctx context.Context, host string, qt uint16) (addrs []netip.Addr, ttl time.Duration, err error)
+
+func newNsCache(size int, timeout time.Duration) *nsCache {
+	return &nsCache{
+		size:    size,
+		timeout: timeout,
+		l:       list.New(),
+		em:      make(map[string]*list.Element),
+	}
+}
+
+// lookup returns cached addresses of host or calls f to look them up.
+// Queries of the lookup are counted in the scanStats of every caller
+// that waited for it.
+func (c *nsCache) lookup(ctx context.Context, host string, qt uint16, f addrLookupFunc) ([]netip.Addr, error) {
+	key := strings.ToLower(host) + "/" + strconv.Itoa(int(qt)) // Names are case-insensitive.
+	if e, ok := c.get(key); ok {
+		c.hits.Add(1)
+		return e.addrs, e.err
+	}
+	c.misses.Add(1)
+
+	ch := c.sf.DoChan(key, func() (any, error) {
+		// A lookup may have finished between c.get and c.sf.DoChan.
+		if e, ok := c.get(key); ok {
+			return nsLookupResult{addrs: e.addrs}, e.err
+		}
+
+		// The lookup is shared by all callers. Don't let the first caller's
+		// cancellation fail others, and don't wait forever.
+		fctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		fctx, st := withScanStats(fctx)
+		addrs, ttl, err := f(fctx, host, qt)
+		if ttl > 0 {
+			c.store(&nsCacheEntry{key: key, addrs: addrs, err: err, expire: time.Now().Add(ttl)})
+		}
+		return nsLookupResult{addrs: addrs, stats: st}, err
+	})
+	select {
+	case res := <-ch:
+		if res.Shared {
+			c.shared.Add(1)
+		}
+		lr, _ := res.Val.(nsLookupResult)
+		scanStatsFrom(ctx).add(lr.stats)
+		return lr.addrs, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *nsCache) get(key string) (*nsCacheEntry, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	le, ok := c.em[key]
+	if !ok {
+		return nil, false
+	}
+	e := le.Value.(*nsCacheEntry)
+	if time.Now().After(e.expire) {
+		c.l.Remove(le)
+		delete(c.em, key)
+		return nil, false
+	}
+	c.l.MoveToFront(le)
+	return e, true
+}
+
+func (c *nsCache) store(e *nsCacheEntry) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if le, ok := c.em[e.key]; ok {
+		le.Value = e
+		c.l.MoveToFront(le)
+		return
+	}
+	c.em[e.key] = c.l.PushFront(e)
+	for c.l.Len() > c.size {
+		le := c.l.Back()
+		c.l.Remove(le)
+		delete(c.em, le.Value.(*nsCacheEntry).key)
+	}
+}
+
+type nsCacheStats struct {
+	hits   uint64
+	misses uint64
+	shared uint64
+}
+
+func (c *nsCache) stats() nsCacheStats {
+	return nsCacheStats{
+		hits:   c.hits.Load(),
+		misses: c.misses.Load(),
+		shared: c.shared.Load(),
+	}
+}
+
+// cacheTtl returns the ttl of a result that can be cached. Successful and
+// NXDOMAIN results can be cached. For negative results, ttl comes from the
+// SOA record in the authority section (RFC 2308).
+func cacheTtl(resp *dns.Msg, err error) time.Duration {
+	var rErr rcodeError
+	switch {
+	case err == nil:
+	case errors.As(err, &rErr) && int(rErr) == dns.RcodeNameError:
+	default:
+		return 0
+	}
+
+	var ttl time.Duration
+	if err == nil && len(resp.Answer) > 0 {
+		for i, rr := range resp.Answer {
+			if t := time.Duration(rr.Header().Ttl) * time.Second; i == 0 || t < ttl {
+				ttl = t
+			}
+		}
+	} else {
+		ttl = defaultNegativeTtl
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+				break
+			}
+		}
+	}
+	return min(ttl, maxNsCacheTtl)
+}
@@ -0,0 +1,98 @@
+package scan
+
+import (
+	"context"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_nsCache(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	var calls atomic.Int32
+	block := make(chan struct{})
+	f := func(ctx context.Context, host string, qt uint16) ([]netip.Addr, time.Duration, error) {
+		calls.Add(1)
+		<-block
+		if host == "nx." {
+			return nil, time.Minute, rcodeError(dns.RcodeNameError)
+		}
+		if host == "no-cache." {
+			return nil, 0, context.DeadlineExceeded
+		}
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, time.Minute, nil
+	}
+
+	c := newNsCache(2, time.Minute)
+
+	// Concurrent lookups are de-duplicated. The lookup is blocked until all
+	// callers have missed the cache.
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := c.lookup(ctx, "a.", dns.TypeA, f)
+			assert.NoError(t, err)
+			assert.Len(t, addrs, 1)
+		}()
+	}
+	for c.stats().misses < 8 {
+		runtime.Gosched()
+	}
+	close(block)
+	wg.Wait()
+	r.Equal(int32(1), calls.Load())
+	r.Equal(uint64(8), c.stats().misses)
+
+	_, err := c.lookup(ctx, "a.", dns.TypeA, f)
+	r.NoError(err)
+	r.Equal(int32(1), calls.Load())
+	r.Equal(uint64(1), c.stats().hits)
+
+	// Names are case-insensitive.
+	_, err = c.lookup(ctx, "A.", dns.TypeA, f)
+	r.NoError(err)
+	r.Equal(int32(1), calls.Load())
+	r.Equal(uint64(2), c.stats().hits)
+
+	// Negative results are cached, errors are not.
+	for i := 0; i < 2; i++ {
+		_, err = c.lookup(ctx, "nx.", dns.TypeA, f)
+		r.Equal(rcodeError(dns.RcodeNameError), err)
+		_, err = c.lookup(ctx, "no-cache.", dns.TypeA, f)
+		r.Error(err)
+	}
+	r.Equal(int32(4), calls.Load())
+
+	// "a." is the least recently used and is evicted.
+	c.store(&nsCacheEntry{key: "b./1", expire: time.Now().Add(time.Minute)})
+	_, ok := c.get("a./1")
+	r.False(ok)
+}
+
+func Test_nsCache_lookupContext(t *testing.T) {
+	r := require.New(t)
+
+	// Lookups are not bound to contexts of callers, but have a timeout.
+	// Their queries are counted in stats of callers.
+	c := newNsCache(2, time.Millisecond*10)
+	f := func(ctx context.Context, host string, qt uint16) ([]netip.Addr, time.Duration, error) {
+		scanStatsFrom(ctx).attempts.Add(2)
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+	ctx, st := withScanStats(context.Background())
+	_, err := c.lookup(ctx, "a.", dns.TypeA, f)
+	r.ErrorIs(err, context.DeadlineExceeded)
+	r.Equal(int32(2), st.attempts.Load())
+}
@@ -0,0 +1,88 @@
+package scan
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// loadScanned reads an existing jsonl output file and returns resumeKeys of
+// results that don't need to be scanned again. If retryErrs is true, results
+// whose last record has errors are excluded so they will be scanned again.
+// validSize is the size of the file that only contains complete lines.
+// Any bytes after validSize are leftovers from an interrupted write.
+// If the file does not exist, loadScanned returns an empty map and no error.
+func loadScanned(fp string, retryErrs bool) (scanned map[string]struct{}, validSize int64, err error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return make(map[string]struct{}), 0, nil
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+	return readScanned(f, retryErrs)
+}
+
+func readScanned(r io.Reader, retryErrs bool) (map[string]struct{}, int64, error) {
+	type record struct {
+		Fqdn string   `json:"fqdn"`
+		Ecs  string   `json:"ecs"`
+		Errs []string `json:"errs"`
+	}
+
+	ok := make(map[string]bool) // resumeKey -> last record has no error
+	br := bufio.NewReader(r)
+	off := int64(0)
+	lineNum := 0
+	for {
+		b, err := br.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				break // b is a partial line (or empty), drop it.
+			}
+			return nil, 0, err
+		}
+		off += int64(len(b))
+		lineNum++
+
+		var rec record
+		if err := json.Unmarshal(b, &rec); err != nil || len(rec.Fqdn) == 0 {
+			logger.Warn("invalid line in output file, ignored", zap.Int("line", lineNum), zap.Error(err))
+			continue
+		}
+		ok[resumeKey(rec.Fqdn, rec.Ecs)] = len(rec.Errs) == 0
+	}
+
+	scanned := make(map[string]struct{}, len(ok))
+	for k, noErr := range ok {
+		if retryErrs && !noErr {
+			continue
+		}
+		scanned[k] = struct{}{}
+	}
+	return scanned, off, nil
+}
+
+// openOutput opens the output file. If resume is false, the file will be truncated.
+// Otherwise, the file will be truncated to validSize and opened in append mode.
+func openOutput(fp string, resume bool, validSize int64) (*os.File, error) {
+	if !resume {
+		return os.Create(fp)
+	}
+	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(validSize); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to truncate partial line, %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,37 @@
+package scan
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_readScanned(t *testing.T) {
+	r := require.New(t)
+	data := `{"fqdn":"a.com.","nss":["ns1.a.com."]}
+{"fqdn":"b.com.","errs":["no ns record"]}
+invalid line
+{"fqdn":"c.com.","errs":["failed to lookup ns, bad rcode 2"]}
+{"fqdn":"c.com."}
+{"fqdn":"d.co`
+
+	scanned, n, err := readScanned(strings.NewReader(data), false)
+	r.NoError(err)
+	r.Equal(int64(strings.LastIndexByte(data, '\n')+1), n)
+	r.Equal(map[string]struct{}{"a.com.": {}, "b.com.": {}, "c.com.": {}}, scanned)
+
+	scanned, _, err = readScanned(strings.NewReader(data), true)
+	r.NoError(err)
+	r.Equal(map[string]struct{}{"a.com.": {}, "c.com.": {}}, scanned)
+}
+
+func Test_readScanned_ecs(t *testing.T) {
+	r := require.New(t)
+	data := `{"fqdn":"a.com.","ecs":"1.2.3.0/24"}
+{"fqdn":"a.com.","ecs":"5.6.7.0/24","errs":["no ns record"]}
+`
+	scanned, _, err := readScanned(strings.NewReader(data), true)
+	r.NoError(err)
+	r.Equal(map[string]struct{}{resumeKey("a.com.", "1.2.3.0/24"): {}}, scanned)
+}
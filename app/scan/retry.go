@@ -0,0 +1,67 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxRetryBackoff = time.Second * 10
+	maxRcode        = 0xfff // Rcodes are 12 bits with the EDNS extended rcode.
+)
+
+// retryPolicy decides whether a failed upstream query will be sent again.
+// The zero value never retries.
+type retryPolicy struct {
+	maxAttempts  int              // Including the first attempt.
+	rcodes       map[int]struct{} // Retryable rcodes. Errors (e.g. timeouts) are always retryable.
+	backoff      time.Duration    // Wait time before the first retry. Doubled on every retry.
+	sameUpstream bool             // If false, retries go to different upstreams when possible.
+}
+
+// parseRetryRcodes parses rcode names (e.g. "SERVFAIL") or numbers.
+func parseRetryRcodes(ss []string) (map[int]struct{}, error) {
+	m := make(map[int]struct{})
+	for _, s := range ss {
+		s = strings.ToUpper(strings.TrimSpace(s))
+		rcode, ok := dns.StringToRcode[s]
+		if !ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 || n > maxRcode {
+				return nil, fmt.Errorf("invalid rcode %s", s)
+			}
+			rcode = n
+		}
+		m[rcode] = struct{}{}
+	}
+	return m, nil
+}
+
+func (p *retryPolicy) retryable(resp *dns.Msg, err error) bool {
+	if err != nil {
+		return true
+	}
+	_, ok := p.rcodes[resp.Rcode]
+	return ok
+}
+
+// wait waits for the backoff before the retry after attempt.
+func (p *retryPolicy) wait(ctx context.Context, attempt int) error {
+	if p.backoff <= 0 {
+		return ctx.Err()
+	}
+	d := min(p.backoff<<min(attempt-1, 16), maxRetryBackoff)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
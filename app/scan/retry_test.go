@@ -0,0 +1,21 @@
+package scan
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseRetryRcodes(t *testing.T) {
+	r := require.New(t)
+
+	m, err := parseRetryRcodes([]string{"servfail", " REFUSED ", "23"})
+	r.NoError(err)
+	r.Equal(map[int]struct{}{dns.RcodeServerFailure: {}, dns.RcodeRefused: {}, dns.RcodeBadCookie: {}}, m)
+
+	for _, s := range []string{"2x", "-1", "4096", "", "NOPE"} {
+		_, err := parseRetryRcodes([]string{s})
+		r.Error(err, s)
+	}
+}
@@ -1,6 +1,8 @@
 package scan
 
 import (
+	"time"
+
 	"github.com/IrineSistiana/nsloc/app"
 	"github.com/IrineSistiana/nsloc/pkg/mlog"
 	"github.com/spf13/cobra"
@@ -19,10 +21,52 @@ var (
 type args struct {
 	concurrent int
 	sps        int
+	adaptive   bool
 	upstream   []string
-	geoipFp    string
-	inputFp    string
-	outFp      string
+	strategy   string
+	vantage    []string
+
+	authQps       int
+	authPrefixQps int
+
+	sockets           int
+	socketRotate      time.Duration
+	batchIO           bool
+	caseRandomization bool
+	cookies           bool
+	ecs               []string
+	timeout           time.Duration
+	retransmit        time.Duration
+	retransmitBackoff float64
+	domainTimeout     time.Duration
+
+	maxAttempts       int
+	retryRcodes       []string
+	retryBackoff      time.Duration
+	retrySameUpstream bool
+
+	tlsCaFp     string
+	tlsInsecure bool
+	dohGet      bool
+
+	geoipFp string
+	asnFp   string
+	inputFp string
+	outFp   string
+
+	targets     []string
+	detail      bool
+	mode        string
+	rootHintsFp string
+
+	delegation bool
+	lame       bool
+
+	nsCacheSize int
+	glue        string
+
+	resume          bool
+	resumeRetryErrs bool
 }
 
 func newScanCmd() *cobra.Command {
@@ -42,10 +86,44 @@ func newScanCmd() *cobra.Command {
 	}
 	c.PersistentFlags().IntVar(&a.concurrent, "cc", 20, "maximum number of concurrent queries")
 	c.PersistentFlags().IntVar(&a.sps, "sps", 100, "maximum number of scan domains pre sec")
-	c.PersistentFlags().StringArrayVarP(&a.upstream, "upstream", "u", []string{"8.8.8.8:53"}, "dns upstream server that can solve domain's addresses")
+	c.PersistentFlags().BoolVar(&a.adaptive, "adaptive", false, "adjust the scan rate automatically, it increases while queries are healthy and decreases when timeouts or REFUSED responses spike, --sps is the maximum rate")
+	c.PersistentFlags().IntVar(&a.authQps, "auth-qps", 50, "maximum queries per sec to each authoritative server address (iterative mode, --delegation, --lame), independent of --sps, 0 means no limit")
+	c.PersistentFlags().IntVar(&a.authPrefixQps, "auth-prefix-qps", 200, "maximum queries per sec to each /24 (ipv4) or /48 (ipv6) network of authoritative servers, 0 means no limit")
+	c.PersistentFlags().StringArrayVarP(&a.upstream, "upstream", "u", []string{"8.8.8.8:53"}, "dns upstream server that can solve domain's addresses, \"ip:port\" for udp, \"tls://host[:port]\" for DNS-over-TLS, \"https://host[:port]/path\" for DNS-over-HTTPS")
+	c.PersistentFlags().StringArrayVar(&a.vantage, "vantage", nil, "scan each domain through a named upstream group, \"name=upstream\", can be repeated, upstreams with the same name are in one group, -u will be ignored, results of groups are compared")
+	c.PersistentFlags().StringVar(&a.strategy, "upstream-strategy", strategyRandom, "how to select upstreams, \"random\", \"round-robin\", \"weighted\" or \"lowest-latency\", failing upstreams will be ejected temporarily")
+	c.PersistentFlags().IntVar(&a.sockets, "sockets", 1, "number of udp sockets (source ports) that queries are spread across")
+	c.PersistentFlags().DurationVar(&a.socketRotate, "socket-rotate", 0, "replace an udp socket with a new one (new source port) every interval, 0 disables the rotation")
+	c.PersistentFlags().BoolVar(&a.batchIO, "batch-io", false, "read and write udp packets in batches with recvmmsg/sendmmsg (linux only), reduces cpu usage at high --sps")
+	c.PersistentFlags().BoolVar(&a.caseRandomization, "0x20", false, "randomize the case of qnames in udp queries (DNS 0x20), responses that do not echo the exact qname will be dropped")
+	c.PersistentFlags().BoolVar(&a.cookies, "cookies", false, "send dns cookies (RFC 7873) in udp queries, for servers that rate limit or refuse clients without cookies")
+	c.PersistentFlags().StringArrayVar(&a.ecs, "ecs", nil, "attach the EDNS Client Subnet (e.g. \"1.2.3.0/24\") to upstream queries, can be repeated, each domain will be scanned once with each subnet")
+	c.PersistentFlags().DurationVar(&a.timeout, "timeout", time.Second*5, "timeout of each query")
+	c.PersistentFlags().DurationVar(&a.retransmit, "retransmit", time.Second, "time that an udp query will be sent again if no response was received")
+	c.PersistentFlags().Float64Var(&a.retransmitBackoff, "retransmit-backoff", 1, "multiplier of the retransmit interval after every retransmit, 1 keeps the interval constant")
+	c.PersistentFlags().DurationVar(&a.domainTimeout, "domain-timeout", 0, "maximum time of the scan of one domain including all its queries, 0 means no limit")
+	c.PersistentFlags().IntVar(&a.maxAttempts, "max-attempts", 1, "maximum number of attempts of each upstream query, queries that failed with errors (e.g. timeout) or --retry-rcodes will be retried")
+	c.PersistentFlags().StringSliceVar(&a.retryRcodes, "retry-rcodes", []string{"SERVFAIL"}, "rcodes that will be retried, names or numbers")
+	c.PersistentFlags().DurationVar(&a.retryBackoff, "retry-backoff", time.Millisecond*100, "wait time before the first retry, doubled on every retry")
+	c.PersistentFlags().BoolVar(&a.retrySameUpstream, "retry-same-upstream", false, "retry on the same upstream instead of a different one")
+	c.PersistentFlags().StringVar(&a.tlsCaFp, "tls-ca", "", "pem file of ca certificates to verify encrypted upstreams, default is system ca")
+	c.PersistentFlags().BoolVar(&a.dohGet, "doh-get", false, "send DNS-over-HTTPS queries with GET instead of POST")
+	c.PersistentFlags().BoolVar(&a.tlsInsecure, "tls-insecure", false, "do not verify certificates of encrypted upstreams")
+	c.PersistentFlags().StringSliceVar(&a.targets, "targets", []string{targetNs}, "what to scan, \"ns\": name servers, \"apex\": addresses of the domain, \"www\": addresses of the www subdomain, \"mx\": mail exchangers")
+	c.PersistentFlags().BoolVar(&a.detail, "detail", false, "output structured host and address objects instead of flat arrays")
+	c.PersistentFlags().StringVar(&a.mode, "mode", modeRecursive, "resolving mode, \"recursive\": send queries to upstreams, \"iterative\": walk the delegation from root servers")
+	c.PersistentFlags().StringVar(&a.rootHintsFp, "root-hints", "", "root hints file (zone file format) for iterative mode, builtin root hints will be used if empty")
 	c.PersistentFlags().StringVarP(&a.inputFp, "input", "i", "", "input domain files")
 	c.PersistentFlags().StringVarP(&a.geoipFp, "geoip", "g", "", "mmdb file with country data")
+	c.PersistentFlags().StringVar(&a.asnFp, "asn", "", "optional mmdb file with asn data (e.g. GeoLite2-ASN), adds asn and organization of each address")
 	c.PersistentFlags().StringVarP(&a.outFp, "out", "o", "out.jsonl", "output file")
+	c.PersistentFlags().BoolVar(&a.delegation, "delegation", false, "also query the NS set from the parent zone and the child zone servers directly, and compare them")
+	c.PersistentFlags().BoolVar(&a.lame, "lame", false, "send a SOA query to each name server address to detect lame delegations")
+	c.PersistentFlags().IntVar(&a.nsCacheSize, "ns-cache", defaultNsCacheEntries, "maximum number of cached name server addresses that are shared by all domains, 0 disables the cache")
+	c.PersistentFlags().StringVar(&a.glue, "glue", glueOff, "use name server addresses from the additional section of the NS response instead of looking them up, \"off\", \"all\", \"bailiwick\" (only name servers under the parent zone) or \"domain\" (only name servers under the domain), --glue means \"all\"")
+	c.PersistentFlags().Lookup("glue").NoOptDefVal = glueAll
+	c.PersistentFlags().BoolVar(&a.resume, "resume", false, "resume from the existing output file, skip domains that were already scanned")
+	c.PersistentFlags().BoolVar(&a.resumeRetryErrs, "resume-retry-errs", false, "with --resume, scan domains that have errors in the output file again")
 	c.MarkFlagRequired("input")
 	c.MarkFlagRequired("geoip")
 	return c
@@ -2,14 +2,14 @@ package scan
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
-	"net"
 	"net/netip"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,30 +25,134 @@ import (
 )
 
 func runScan(ctx context.Context, a args) error {
-	var upstreamAddrs []netip.AddrPort
-	for _, s := range a.upstream {
-		ap, err := netip.ParseAddrPort(s)
-		if err != nil {
-			return fmt.Errorf("invalid upstream, %w", err)
+	targets, err := parseTargets(a.targets)
+	if err != nil {
+		return err
+	}
+	ecss, err := parseEcsList(a.ecs)
+	if err != nil {
+		return err
+	}
+	if len(ecss) > 0 && a.mode == modeIterative {
+		return errors.New("--ecs is not supported in iterative mode")
+	}
+	if len(a.vantage) > 0 {
+		if a.mode == modeIterative {
+			return errors.New("--vantage is not supported in iterative mode")
+		}
+		if len(ecss) > 0 {
+			return errors.New("--vantage and --ecs can not be used together")
 		}
-		upstreamAddrs = append(upstreamAddrs, ap)
 	}
-	if len(upstreamAddrs) == 0 {
-		return errors.New("no upstream address")
+	if a.adaptive && a.mode == modeIterative {
+		// Only upstream queries are observed. Responses of authoritative
+		// servers (e.g. lame ones) are scan results, not upstream health.
+		return errors.New("--adaptive is not supported in iterative mode")
+	}
+	switch a.glue {
+	case glueOff, glueAll, glueBailiwick, glueDomain:
+	default:
+		return fmt.Errorf("invalid glue mode %q", a.glue)
+	}
+	retryRcodes, err := parseRetryRcodes(a.retryRcodes)
+	if err != nil {
+		return err
 	}
 
-	uc, err := net.ListenUDP("udp", nil)
+	dc, err := dnsClient.NewUDP(dnsClient.UDPOptions{
+		Sockets:        a.sockets,
+		RotateInterval: a.socketRotate,
+		Batch:          a.batchIO,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to open socket, %w", err)
+		return err
 	}
-	dc := dnsClient.New(uc)
+	dc.Timeout = a.timeout
+	dc.RetransmitInterval = a.retransmit
+	dc.RetransmitBackoff = a.retransmitBackoff
+	dc.CaseRandomization = a.caseRandomization
+	dc.Cookies = a.cookies
 	defer dc.Close()
+	defer logUdpStats(dc)
+	// Don't close idle stream connections sooner than a query can take.
+	streamIdleTimeout := max(a.timeout, minStreamIdleTimeout)
+	tc := dnsClient.NewTCP()
+	tc.Timeout = a.timeout
+	tc.IdleTimeout = streamIdleTimeout
+	defer tc.Close()
+
+	var upstreams []*upstream
+	var pool *upstreamPool
+	var vantages []*vantage
+	var roots []netip.Addr
+	switch a.mode {
+	case modeRecursive:
+		tlsConfig, err := newTLSConfig(a.tlsCaFp, a.tlsInsecure)
+		if err != nil {
+			return fmt.Errorf("invalid tls config, %w", err)
+		}
+		opts := upstreamOpts{
+			udp:           dc,
+			tcp:           tc,
+			tlsConfig:     tlsConfig,
+			httpTransport: dnsClient.NewHTTPTransport(tlsConfig),
+			dohGet:        a.dohGet,
+			timeout:       a.timeout,
+			idleTimeout:   streamIdleTimeout,
+		}
+		defer opts.httpTransport.CloseIdleConnections()
+		if len(a.vantage) > 0 {
+			vantages, err = parseVantages(a.vantage, a.strategy, opts)
+			if err != nil {
+				return err
+			}
+			for _, v := range vantages {
+				defer v.close()
+				defer v.pool.logStats()
+			}
+			break
+		}
+		for _, s := range a.upstream {
+			u, err := parseUpstream(s, opts)
+			if err != nil {
+				return fmt.Errorf("invalid upstream %s, %w", s, err)
+			}
+			defer u.close()
+			upstreams = append(upstreams, u)
+		}
+		if len(upstreams) == 0 {
+			return errors.New("no upstream address")
+		}
+		pool, err = newUpstreamPool(a.strategy, upstreams)
+		if err != nil {
+			return err
+		}
+		defer pool.logStats()
+	case modeIterative:
+		var err error
+		roots, err = loadRootHints(a.rootHintsFp)
+		if err != nil {
+			return fmt.Errorf("failed to load root hints, %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid mode %s", a.mode)
+	}
 
 	geoReader, err := geoip2.Open(a.geoipFp)
 	if err != nil {
 		return fmt.Errorf("failed to open geoip file, %w", err)
 	}
 
+	var asnReader asnDB
+	if len(a.asnFp) > 0 {
+		r, err := geoip2.Open(a.asnFp)
+		if err != nil {
+			return fmt.Errorf("failed to open asn file, %w", err)
+		}
+		defer r.Close()
+		asnReader = r
+	}
+
 	inputF, err := os.Open(a.inputFp)
 	if err != nil {
 		return fmt.Errorf("failed to open input file, %w", err)
@@ -64,19 +168,92 @@ func runScan(ctx context.Context, a args) error {
 		return fmt.Errorf("failed to read input file, %w", err)
 	}
 
-	out, err := os.Create(a.outFp)
+	var scanned map[string]struct{} // resumeKey
+	var validSize int64
+	if a.resume {
+		scanned, validSize, err = loadScanned(a.outFp, a.resumeRetryErrs)
+		if err != nil {
+			return fmt.Errorf("failed to load previous output, %w", err)
+		}
+	}
+
+	out, err := openOutput(a.outFp, a.resume, validSize)
 	if err != nil {
-		return fmt.Errorf("failed to create output file, %w", err)
+		return fmt.Errorf("failed to open output file, %w", err)
 	}
 	defer out.Close()
 
 	scanner := &scanner{
-		dnsClient:     dc,
-		geoReader:     geoReader,
-		upstreamAddrs: upstreamAddrs,
+		authUDP:   dc,
+		authTCP:   tc,
+		geoReader: geoReader,
+		asnReader: asnReader,
+		upstreams: pool,
+		authPort:  53,
+		targets:   targets,
+		detail:    a.detail,
+
+		domainTimeout: a.domainTimeout,
+
+		checkDelegation: a.delegation,
+		parentZones:     newZoneCache(),
+		checkLame:       a.lame,
+	}
+	if a.authQps > 0 || a.authPrefixQps > 0 {
+		scanner.authLimiter = newAuthLimiter(a.authQps, a.authPrefixQps)
+	}
+	scanner.retry = retryPolicy{
+		maxAttempts:  a.maxAttempts,
+		rcodes:       retryRcodes,
+		backoff:      a.retryBackoff,
+		sameUpstream: a.retrySameUpstream,
+	}
+	scanner.glue = a.glue
+	if a.nsCacheSize > 0 {
+		lookupTimeout := defaultNsLookupTimeout
+		if a.domainTimeout > 0 {
+			lookupTimeout = a.domainTimeout
+		}
+		scanner.nsCache = newNsCache(a.nsCacheSize, lookupTimeout)
+	}
+	if a.mode == modeIterative {
+		scanner.iter = newIterResolver(roots, scanner.authPort, scanner.exchangeAuth)
+	}
+	rl := rate.NewLimiter(rate.Limit(a.sps), a.sps)
+	if a.adaptive {
+		scanner.adaptive = newAdaptiveRate(rl, float64(a.sps))
+		go scanner.adaptive.run(ctx)
 	}
 
-	bar := progressbar.NewOptions(len(domains),
+	// Domains are scanned once by each of the scanners.
+	scanners := scanner.withEcsList(ecss)
+	var vs *vantageScanner // Merges results of scanners.
+	if len(vantages) > 0 {
+		vs = scanner.withVantages(vantages)
+		scanners = vs.scanners
+	}
+	for _, sc := range scanners {
+		if sc.nsCache != nil {
+			defer logNsCacheStats(sc.nsCache)
+		}
+	}
+
+	var jobs []scanJob
+	skipped := 0
+	for d := range domains {
+		for _, sc := range scanners {
+			if _, ok := scanned[sc.resultKey(d)]; ok {
+				skipped++
+				continue
+			}
+			jobs = append(jobs, scanJob{fqdn: d, s: sc})
+		}
+	}
+	if a.resume {
+		logger.Info("resuming scan", zap.Int("skipped", skipped), zap.Int("remaining", len(jobs)))
+	}
+
+	bar := progressbar.NewOptions(len(jobs),
 		progressbar.OptionThrottle(time.Second),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowCount(),
@@ -89,13 +266,12 @@ func runScan(ctx context.Context, a args) error {
 	)
 
 	grLimiter := newGrPool(a.concurrent)
-	rl := rate.NewLimiter(rate.Limit(a.sps), a.sps)
 	wg := new(sync.WaitGroup)
 	resChan := make(chan *Result)
 	doneChan := make(chan struct{})
 	go func() {
-		for d := range domains {
-			d := d
+		for _, j := range jobs {
+			j := j
 			select {
 			case <-ctx.Done():
 				return
@@ -111,7 +287,7 @@ func runScan(ctx context.Context, a args) error {
 					}
 
 					select {
-					case resChan <- scanner.scan(ctx, d):
+					case resChan <- j.s.scan(ctx, j.fqdn):
 					case <-ctx.Done():
 					}
 				}()
@@ -132,13 +308,24 @@ func runScan(ctx context.Context, a args) error {
 			bar.Finish()
 			return nil
 		case res := <-resChan:
-			bar.Describe(fmt.Sprintf("Scanning...[%s][t: %dms]", res.Fqdn, res.ElapsedMs))
+			if scanner.adaptive != nil {
+				bar.Describe(fmt.Sprintf("Scanning...[%s][t: %dms][sps: %.0f]", res.Fqdn, res.ElapsedMs, scanner.adaptive.rate()))
+			} else {
+				bar.Describe(fmt.Sprintf("Scanning...[%s][t: %dms]", res.Fqdn, res.ElapsedMs))
+			}
 			bar.Add(1)
+			if vs != nil {
+				if res = vs.add(res); res == nil {
+					continue // Waiting for other vantages.
+				}
+			}
 
 			encoder := json.NewEncoder(bb)
 			if err := encoder.Encode(res); err != nil {
 				return fmt.Errorf("failed to encode result, %w", err)
 			}
+			// Write the whole line in one call. An interrupted write leaves at most
+			// one partial line at the end of the file, which will be dropped by --resume.
 			if _, err := out.Write(bb.Bytes()); err != nil {
 				return fmt.Errorf("failed to write output, %w", err)
 			}
@@ -147,108 +334,395 @@ func runScan(ctx context.Context, a args) error {
 	}
 }
 
+// scanJob is a domain that will be scanned by s.
+type scanJob struct {
+	fqdn string
+	s    *scanner
+}
+
 type Result struct {
 	Fqdn      string   `json:"fqdn,omitempty"`
+	Ecs       string   `json:"ecs,omitempty"` // Only available with --ecs.
 	ElapsedMs int64    `json:"elapsed_ms,omitempty"`
 	Nss       []string `json:"nss,omitempty"`
 	NsAddrs   []string `json:"ns_addrs,omitempty"`
 	LocCodes  []string `json:"locs,omitempty"`
-	Errs      []string `json:"errs,omitempty"`
+
+	// Only available with --glue. Addresses in NsAddrs that came from the
+	// additional section of the NS response instead of explicit lookups.
+	NsGlueAddrs []string `json:"ns_glue_addrs,omitempty"`
+
+	// Only available with --targets mx. Mxs are sorted by preference.
+	Mxs        []string `json:"mxs,omitempty"`
+	MxAddrs    []string `json:"mx_addrs,omitempty"`
+	MxLocCodes []string `json:"mx_locs,omitempty"`
+
+	// Only available with --targets apex/www.
+	ApexAddrs    []string `json:"apex_addrs,omitempty"`
+	ApexLocCodes []string `json:"apex_locs,omitempty"`
+	WwwAddrs     []string `json:"www_addrs,omitempty"`
+	WwwLocCodes  []string `json:"www_locs,omitempty"`
+
+	// Only available with --detail. They replace above flat fields.
+	NsDetail   []HostDetail `json:"ns_detail,omitempty"`
+	MxDetail   []HostDetail `json:"mx_detail,omitempty"`
+	ApexDetail []AddrDetail `json:"apex_detail,omitempty"`
+	WwwDetail  []AddrDetail `json:"www_detail,omitempty"`
+
+	// Only available with --asn.
+	Asns []AddrAsn `json:"asns,omitempty"`
+
+	// Only available with --delegation.
+	ParentNss  []string `json:"parent_nss,omitempty"`
+	ChildNss   []string `json:"child_nss,omitempty"`
+	NsMismatch *bool    `json:"ns_mismatch,omitempty"` // nil if the NS sets were not compared.
+	ParentAuth bool     `json:"parent_auth,omitempty"` // The parent zone server is authoritative for the domain, there is no referral to compare.
+
+	// Only available with --lame.
+	NsChecks       []NsCheck `json:"ns_checks,omitempty"`
+	Lame           bool      `json:"lame,omitempty"`
+	SerialMismatch bool      `json:"serial_mismatch,omitempty"`
+
+	// Number of queries that were retried through TCP because
+	// the UDP response was truncated.
+	TcpFallbacks int `json:"tcp_fallbacks,omitempty"`
+
+	// Number of queries that were sent to upstreams, including retries.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Only available with --ecs. The largest scope prefix length of
+	// all responses. 0 means no answer depends on the subnet.
+	EcsScope int `json:"ecs_scope,omitempty"`
+
+	// Only available with --vantage. Results of each vantage. Errors of
+	// vantages are in Errs of the top level result.
+	Vantage     string    `json:"vantage,omitempty"`
+	Vantages    []*Result `json:"vantages,omitempty"`
+	VantageDiff bool      `json:"vantage_diff,omitempty"` // Results of vantages are different.
+
+	Errs []string `json:"errs,omitempty"`
 }
 
 type scanner struct {
-	dnsClient     *dnsClient.Client
-	geoReader     *geoip2.Reader
-	upstreamAddrs []netip.AddrPort
+	authUDP   dnsClient.Transport // Transports of queries that are sent to authoritative servers directly.
+	authTCP   dnsClient.Transport
+	geoReader geoDB // If nil, addresses won't be located. (tests)
+	asnReader asnDB // Optional.
+	upstreams *upstreamPool
+	retry     retryPolicy
+
+	domainTimeout time.Duration // If > 0, the maximum time of the scan of one domain.
+	adaptive      *adaptiveRate // Optional. Observes upstream queries.
+	authLimiter   *authLimiter  // Optional. Limits queries to each authoritative server.
+
+	ecs     *dns.EDNS0_SUBNET // Optional. Attached to upstream queries.
+	ecsName string
+	vantage string // Name of the vantage of upstreams. Optional.
+
+	targets scanTargets
+	detail  bool
+
+	iter     *iterResolver // If not nil, queries are resolved iteratively instead of sending to upstreams.
+	authPort uint16        // Port of authoritative servers.
+
+	checkDelegation bool
+	parentZones     *zoneCache
+	checkLame       bool
+
+	nsCache *nsCache // Optional.
+
+	glue string // Which glue to use, see glueAll etc. Empty means glueOff.
 }
 
 func (s *scanner) scan(ctx context.Context, fqdn string) (r *Result) {
 	r = new(Result)
 	r.Fqdn = fqdn
+	r.Ecs = s.ecsName
+	r.Vantage = s.vantage
 
+	if s.domainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.domainTimeout)
+		defer cancel()
+	}
+	ctx, st := withScanStats(ctx)
 	start := time.Now()
 	defer func() {
 		r.ElapsedMs = time.Since(start).Milliseconds()
+		r.TcpFallbacks = int(st.tcpFallbacks.Load())
+		r.Attempts = int(st.attempts.Load())
+		r.EcsScope = int(st.ecsScope.Load())
 	}()
 
-	nss, err := s.queryNs(ctx, fqdn)
-	if err != nil {
-		r.Errs = append(r.Errs, fmt.Sprintf("failed to lookup ns, %s", err))
+	if s.targets.ns {
+		s.scanNs(ctx, r, fqdn)
+	}
+	if s.targets.apex {
+		addrs := s.scanHost(ctx, r, fqdn)
+		if s.detail {
+			r.ApexDetail = s.addrDetails(addrs)
+		} else {
+			r.ApexAddrs, r.ApexLocCodes = s.locate(addrs)
+		}
+	}
+	if s.targets.www {
+		addrs := s.scanHost(ctx, r, "www."+fqdn)
+		if s.detail {
+			r.WwwDetail = s.addrDetails(addrs)
+		} else {
+			r.WwwAddrs, r.WwwLocCodes = s.locate(addrs)
+		}
+	}
+	if s.targets.mx {
+		s.scanMx(ctx, r, fqdn)
+	}
+	if s.asnReader != nil && !s.detail {
+		s.lookupAsns(r)
+	}
+
+	// Just make result looks better.
+	slices.Sort(r.Errs)
+	return
+}
+
+// scanNs scans name servers of fqdn and their locations.
+func (s *scanner) scanNs(ctx context.Context, r *Result, fqdn string) {
+	nss, glue, err := s.queryNsGlue(ctx, fqdn)
+	if err != nil || len(nss) == 0 {
+		if err != nil {
+			r.Errs = append(r.Errs, fmt.Sprintf("failed to lookup ns, %s", err))
+		} else {
+			r.Errs = append(r.Errs, "no ns record")
+		}
+		// Broken delegations still have the parent side data.
+		if s.checkDelegation {
+			s.scanDelegation(ctx, r, fqdn, nil)
+		}
 		return
 	}
-	if len(nss) == 0 {
-		r.Errs = append(r.Errs, "no ns record")
+	switch s.glue {
+	case glueAll:
+	case glueBailiwick, glueDomain:
+		// The delegation of fqdn is served by its parent zone. Glue under
+		// it (e.g. ns1.example.net. for foo.net.) is in bailiwick.
+		zone := fqdn
+		if s.glue == glueBailiwick {
+			zone, _ = parentName(fqdn)
+		}
+		for ns := range glue {
+			if !dns.IsSubDomain(zone, strings.ToLower(ns)) {
+				delete(glue, ns)
+			}
+		}
+	default:
+		glue = nil
+	}
+
+	// Name servers that have glue don't need to be looked up.
+	var lookupNss []string
+	for _, ns := range nss {
+		if len(glue[ns]) == 0 {
+			lookupNss = append(lookupNss, ns)
+		}
+	}
+	if len(lookupNss) > 4 { // Lookup at most 4 name servers. Should be enough.
+		lookupNss = lookupNss[:4]
+	}
+	nsAddrs, errs := s.resolveHosts(ctx, lookupNss, "ns", true)
+	for ns, addrs := range glue {
+		nsAddrs[ns] = addrs
+	}
+	addrsM := make(map[netip.Addr]struct{})
+	for _, addrs := range nsAddrs {
+		for _, a := range addrs {
+			addrsM[a] = struct{}{}
+		}
+	}
+	if s.detail {
+		sortedNss := slices.Clone(nss)
+		slices.Sort(sortedNss)
+		r.NsDetail = s.hostDetails(sortedNss, nsAddrs)
+		if glue != nil {
+			markAddrSource(r.NsDetail, glue)
+		}
+	} else {
+		r.Nss = nss
+		r.NsAddrs, r.LocCodes = s.locate(key(addrsM))
+		var glueAddrs []netip.Addr
+		for _, addrs := range glue {
+			glueAddrs = append(glueAddrs, addrs...)
+		}
+		r.NsGlueAddrs = addrStrings(glueAddrs)
+	}
+
+	if s.checkDelegation {
+		s.scanDelegation(ctx, r, fqdn, key(addrsM))
+	}
+	if s.checkLame {
+		s.scanLame(ctx, r, fqdn, nsAddrs)
+	}
+
+	for _, err := range errs {
+		r.Errs = append(r.Errs, err.Error())
+	}
+
+	// Just make result looks better.
+	slices.Sort(r.Nss)
+}
+
+// scanMx scans mail exchangers of fqdn and their locations.
+func (s *scanner) scanMx(ctx context.Context, r *Result, fqdn string) {
+	mxs, err := s.queryMx(ctx, fqdn)
+	if err != nil {
+		r.Errs = append(r.Errs, fmt.Sprintf("failed to lookup mx, %s", err))
 		return
 	}
-	r.Nss = nss
 
-	errL := new(sync.Mutex)
+	lookupMxs := mxs
+	if len(lookupMxs) > 4 { // Same as ns. Exchangers with lower preference first.
+		lookupMxs = lookupMxs[:4]
+	}
+	mxAddrs, errs := s.resolveHosts(ctx, lookupMxs, "mx", true)
+	if s.detail {
+		r.MxDetail = s.hostDetails(mxs, mxAddrs)
+	} else {
+		r.Mxs = mxs
+		var addrs []netip.Addr
+		for _, a := range mxAddrs {
+			addrs = append(addrs, a...)
+		}
+		r.MxAddrs, r.MxLocCodes = s.locate(addrs)
+	}
+	for _, err := range errs {
+		r.Errs = append(r.Errs, err.Error())
+	}
+}
+
+// scanHost resolves addresses of host.
+func (s *scanner) scanHost(ctx context.Context, r *Result, host string) []netip.Addr {
+	hostAddrs, errs := s.resolveHosts(ctx, []string{host}, "host", false)
+	for _, err := range errs {
+		r.Errs = append(r.Errs, err.Error())
+	}
+	return hostAddrs[host]
+}
+
+// resolveHosts resolves A and AAAA of hosts concurrently.
+// kind is the kind of hosts (e.g. "ns") in error messages.
+// If useCache is true, s.nsCache will be used. Hosts that are shared by
+// many domains (e.g. name servers) should use the cache.
+func (s *scanner) resolveHosts(ctx context.Context, hosts []string, kind string, useCache bool) (map[string][]netip.Addr, []error) {
+	m := new(sync.Mutex)
 	errs := make([]error, 0)
-	addrsL := new(sync.Mutex)
-	addrsM := make(map[netip.Addr]struct{})
+	hostAddrs := make(map[string][]netip.Addr)
 
 	appendErr := func(err error) {
-		errL.Lock()
-		defer errL.Unlock()
+		m.Lock()
+		defer m.Unlock()
 		errs = append(errs, err)
 	}
-	appendNsAddr := func(s []netip.Addr) {
-		addrsL.Lock()
-		defer addrsL.Unlock()
-		for _, a := range s {
-			addrsM[a] = struct{}{}
-		}
+	appendAddrs := func(host string, s []netip.Addr) {
+		m.Lock()
+		defer m.Unlock()
+		hostAddrs[host] = append(hostAddrs[host], s...)
 	}
 
 	wg := new(sync.WaitGroup)
-	for i, ns := range nss {
-		if i > 3 { // Lookup at most 3 name servers. Should be enough.
-			break
-		}
-		ns := ns
+	for _, host := range hosts {
+		host := host
 		for _, qt := range [...]uint16{dns.TypeA, dns.TypeAAAA} {
 			qt := qt
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
 
-				nsAddrs, err := s.queryAddr(ctx, ns, qt)
+				var addrs []netip.Addr
+				var err error
+				if useCache {
+					addrs, err = s.lookupAddr(ctx, host, qt)
+				} else {
+					addrs, err = s.queryAddr(ctx, host, qt)
+				}
 				if err != nil {
-					appendErr(fmt.Errorf("failed to lookup ns %s addr qt=%d, %w", ns, qt, err))
+					appendErr(fmt.Errorf("failed to lookup %s %s addr qt=%d, %w", kind, host, qt, err))
 				}
-				if len(nsAddrs) > 0 {
-					appendNsAddr(nsAddrs)
+				if len(addrs) > 0 {
+					appendAddrs(host, addrs)
 				}
 			}()
 		}
 	}
 	wg.Wait()
+	return hostAddrs, errs
+}
 
-	locCodesM := make(map[string]struct{})
-	for addr := range addrsM {
-		r.NsAddrs = append(r.NsAddrs, addr.String())
+// Modes of --glue.
+const (
+	glueOff       = "off"
+	glueAll       = "all"       // Use all glue.
+	glueBailiwick = "bailiwick" // Only glue of name servers under the parent zone (RFC 8499 in-bailiwick).
+	glueDomain    = "domain"    // Only glue of name servers under the domain (RFC 8499 in-domain).
+)
 
-		c, err := s.geoReader.Country(addr.AsSlice())
-		if err != nil {
-			logger.Error("geoip database read err", zap.Error(err)) // Fatal error maybe?
-			continue
-		}
-		if s := c.Country.IsoCode; len(s) > 0 {
-			locCodesM[s] = struct{}{}
-		}
-	}
-	r.LocCodes = key(locCodesM)
+const (
+	targetNs   = "ns"
+	targetApex = "apex"
+	targetWww  = "www"
+	targetMx   = "mx"
+)
 
-	for _, err := range errs {
-		r.Errs = append(r.Errs, err.Error())
+func logNsCacheStats(c *nsCache) {
+	st := c.stats()
+	hitRate := 0.0
+	if total := st.hits + st.misses; total > 0 {
+		hitRate = float64(st.hits) / float64(total)
 	}
+	logger.Info("ns cache stats",
+		zap.Uint64("hits", st.hits),
+		zap.Uint64("misses", st.misses),
+		zap.Uint64("shared", st.shared),
+		zap.Float64("hit_rate", hitRate),
+	)
+}
 
-	// Just make result looks better.
-	slices.Sort(r.Nss)
-	slices.Sort(r.NsAddrs)
-	slices.Sort(r.LocCodes)
-	slices.Sort(r.Errs)
-	return
+func logUdpStats(c *dnsClient.Client) {
+	st := c.Stats()
+	logger.Info("dropped udp packets",
+		zap.Uint64("malformed", st.Malformed),
+		zap.Uint64("unmatched", st.Unmatched),
+		zap.Uint64("bad_source", st.BadSource),
+		zap.Uint64("bad_cookie", st.BadCookie),
+		zap.Uint64("accepted_no_cookie", st.NoCookie),
+	)
+}
+
+type scanTargets struct {
+	ns   bool
+	apex bool
+	www  bool
+	mx   bool
+}
+
+func parseTargets(s []string) (scanTargets, error) {
+	var t scanTargets
+	for _, target := range s {
+		switch target {
+		case targetNs:
+			t.ns = true
+		case targetApex:
+			t.apex = true
+		case targetWww:
+			t.www = true
+		case targetMx:
+			t.mx = true
+		default:
+			return t, fmt.Errorf("invalid target %s", target)
+		}
+	}
+	if t == (scanTargets{}) {
+		return t, errors.New("no scan target")
+	}
+	return t, nil
 }
 
 type grPool struct {
@@ -272,21 +746,92 @@ func (p *grPool) release() {
 }
 
 func (s *scanner) query(ctx context.Context, fqdn string, qt uint16) (*dns.Msg, error) {
+	if s.iter != nil {
+		return s.iter.resolve(ctx, fqdn, qt)
+	}
+
 	q := new(dns.Msg)
 	q.SetQuestion(fqdn, qt)
-	q.SetEdns0(1200, false)
-	q.Id = s.dnsClient.NextQid()
-	return s.dnsClient.Query(ctx, q, s.upstreamAddrs[rand.Intn(len(s.upstreamAddrs))])
+	q.SetEdns0(1200, false) // Also carries dns cookies, see dnsClient.Client.Cookies.
+	if s.ecs != nil {
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, s.ecs)
+	}
+
+	st := scanStatsFrom(ctx)
+	var prev *upstream
+	for attempt := 1; ; attempt++ {
+		u := s.upstreams.pick(prev)
+		if st != nil {
+			st.attempts.Add(1)
+		}
+		start := time.Now()
+		resp, err := s.exchange(ctx, q, u.ex, u.tcp)
+		if ctx.Err() != nil {
+			return resp, err
+		}
+		s.upstreams.report(u, time.Since(start), resp, err)
+		if s.adaptive != nil {
+			s.adaptive.observe(time.Since(start), resp, err)
+		}
+		if attempt >= s.retry.maxAttempts || !s.retry.retryable(resp, err) {
+			if err == nil && s.ecs != nil && st != nil {
+				st.recordEcsScope(resp)
+			}
+			return resp, err
+		}
+		if !s.retry.sameUpstream {
+			prev = u
+		}
+		if err := s.retry.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// exchangeAuth sends q to an authoritative server.
+func (s *scanner) exchangeAuth(ctx context.Context, q *dns.Msg, server netip.AddrPort) (*dns.Msg, error) {
+	if s.authLimiter != nil {
+		if err := s.authLimiter.wait(ctx, server.Addr()); err != nil {
+			return nil, err
+		}
+	}
+	return s.exchange(ctx, q, s.authUDP.Exchanger(server), s.authTCP.Exchanger(server))
+}
+
+// exchange sends q through ex. If the response is truncated and tcp
+// is not nil, q will be sent again through tcp.
+func (s *scanner) exchange(ctx context.Context, q *dns.Msg, ex, tcp dnsClient.Exchanger) (*dns.Msg, error) {
+	resp, err := ex.Exchange(ctx, q)
+	if err != nil || !resp.Truncated || tcp == nil {
+		return resp, err
+	}
+
+	if st := scanStatsFrom(ctx); st != nil {
+		st.tcpFallbacks.Add(1)
+	}
+	resp, err = tcp.Exchange(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query through tcp after truncated udp response, %w", err)
+	}
+	return resp, nil
 }
 
 func (s *scanner) queryNs(ctx context.Context, fqdn string) ([]string, error) {
+	nss, _, err := s.queryNsGlue(ctx, fqdn)
+	return nss, err
+}
+
+// queryNsGlue is queryNs but also returns addresses of name servers
+// from the additional section.
+func (s *scanner) queryNsGlue(ctx context.Context, fqdn string) ([]string, map[string][]netip.Addr, error) {
 	resp, err := s.query(ctx, fqdn, dns.TypeNS)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if resp.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("bad rcode %d", resp.Rcode)
+		return nil, nil, rcodeError(resp.Rcode)
 	}
 
 	// find ns records
@@ -296,40 +841,109 @@ func (s *scanner) queryNs(ctx context.Context, fqdn string) ([]string, error) {
 			nss = append(nss, ns.Ns)
 		}
 	}
-	return nss, nil
-}
 
-func (s *scanner) queryAddr(ctx context.Context, fqdn string, qt uint16) ([]netip.Addr, error) {
-	if qt != dns.TypeA && qt != dns.TypeAAAA {
-		return nil, fmt.Errorf("invalid query type %d", qt)
+	glue := make(map[string][]netip.Addr)
+	for _, ns := range nss {
+		if addrs := glueAddrs(resp, ".", []string{ns}); len(addrs) > 0 {
+			glue[ns] = addrs
+		}
 	}
+	return nss, glue, nil
+}
 
-	resp, err := s.query(ctx, fqdn, qt)
+// queryMx returns mail exchangers of fqdn, sorted by preference.
+// Null MX (RFC 7505) is ignored.
+func (s *scanner) queryMx(ctx context.Context, fqdn string) ([]string, error) {
+	resp, err := s.query(ctx, fqdn, dns.TypeMX)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("bad rcode %d", resp.Rcode)
+		return nil, rcodeError(resp.Rcode)
 	}
 
-	var addrs []netip.Addr
+	var mxRrs []*dns.MX
 	for _, rr := range resp.Answer {
-		var ip net.IP
-		switch v := rr.(type) {
-		case *dns.A:
-			ip = v.A
-		case *dns.AAAA:
-			ip = v.AAAA
-		default:
-			continue
+		if mx, ok := rr.(*dns.MX); ok && mx.Mx != "." {
+			mxRrs = append(mxRrs, mx)
+		}
+	}
+	slices.SortStableFunc(mxRrs, func(a, b *dns.MX) int {
+		return cmp.Compare(a.Preference, b.Preference)
+	})
+	mxs := make([]string, 0, len(mxRrs))
+	for _, mx := range mxRrs {
+		mxs = append(mxs, mx.Mx)
+	}
+	return mxs, nil
+}
+
+// queryAddr queries addresses of fqdn. If the answer only contains a
+// cname chain, queryAddr follows it.
+func (s *scanner) queryAddr(ctx context.Context, fqdn string, qt uint16) ([]netip.Addr, error) {
+	addrs, _, err := s.queryAddrTtl(ctx, fqdn, qt)
+	return addrs, err
+}
+
+// queryAddrTtl is queryAddr but also returns how long the result can be cached.
+func (s *scanner) queryAddrTtl(ctx context.Context, fqdn string, qt uint16) ([]netip.Addr, time.Duration, error) {
+	if qt != dns.TypeA && qt != dns.TypeAAAA {
+		return nil, 0, fmt.Errorf("invalid query type %d", qt)
+	}
+
+	name := fqdn
+	ttl := maxNsCacheTtl
+	for hop := 0; hop <= maxCnameHops; hop++ {
+		resp, err := s.query(ctx, name, qt)
+		if err != nil {
+			return nil, 0, err
 		}
-		a, ok := netip.AddrFromSlice(ip)
-		if ok {
-			addrs = append(addrs, a)
+
+		if resp.Rcode != dns.RcodeSuccess {
+			err = rcodeError(resp.Rcode)
 		}
+		ttl = min(ttl, cacheTtl(resp, err))
+		if err != nil {
+			return nil, ttl, err
+		}
+
+		if addrs := answerAddrs(resp); len(addrs) > 0 {
+			return addrs, ttl, nil
+		}
+		if name = cnameTarget(resp, name); len(name) == 0 {
+			return nil, ttl, nil
+		}
+	}
+	return nil, 0, errTooManyHops
+}
+
+// lookupAddr is queryAddr but uses s.nsCache if it is enabled.
+func (s *scanner) lookupAddr(ctx context.Context, host string, qt uint16) ([]netip.Addr, error) {
+	if s.nsCache == nil {
+		return s.queryAddr(ctx, host, qt)
+	}
+	return s.nsCache.lookup(ctx, host, qt, s.queryAddrTtl)
+}
+
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return fmt.Sprintf("bad rcode %d", int(e))
+}
+
+// addrStrings returns sorted and deduplicated addresses as strings.
+func addrStrings(addrs []netip.Addr) []string {
+	if len(addrs) == 0 {
+		return nil
+	}
+	ss := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		ss = append(ss, a.String())
 	}
-	return addrs, nil
+	// Sorted as strings, the same as addresses from locate.
+	slices.Sort(ss)
+	return slices.Compact(ss)
 }
 
 func key[K comparable, V any](m map[K]V) []K {
@@ -0,0 +1,430 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	dnsClient "github.com/IrineSistiana/nsloc/pkg/dns_client"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// testPool returns a pool of one upstream that sends queries through ex.
+func testPool(ex dnsClient.Exchanger) *upstreamPool {
+	p, err := newUpstreamPool(strategyRandom, []*upstream{{name: "fake", ex: ex}})
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// fakeRecursor returns a dnsClient.Fake that answers queries from zone text
+// like a recursive server. Cname chains are followed. If truncate is true,
+// responses have the TC bit.
+func fakeRecursor(t *testing.T, zone string, truncate bool) *dnsClient.Fake {
+	rrs := parseZone(t, zone)
+	return &dnsClient.Fake{Handler: func(q *dns.Msg, _ netip.AddrPort) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Truncated = truncate
+		name, qt := q.Question[0].Name, q.Question[0].Qtype
+		for hop := 0; hop < 8; hop++ {
+			next := ""
+			for _, rr := range rrs {
+				h := rr.Header()
+				if !strings.EqualFold(h.Name, name) {
+					continue
+				}
+				if h.Rrtype == qt {
+					r.Answer = append(r.Answer, rr)
+				} else if c, ok := rr.(*dns.CNAME); ok {
+					r.Answer = append(r.Answer, rr)
+					next = c.Target
+				}
+			}
+			if len(next) == 0 {
+				break
+			}
+			name = next
+		}
+		if len(r.Answer) == 0 {
+			r.Rcode = dns.RcodeNameError
+			for _, rr := range rrs {
+				if strings.EqualFold(rr.Header().Name, name) {
+					r.Rcode = dns.RcodeSuccess // NODATA
+				}
+			}
+		}
+		return r, nil
+	}}
+}
+
+const testRecursorZone = `
+example.com.      300 NS    ns1.example.com.
+example.com.      300 NS    ns2.example.net.
+example.com.      300 MX    20 mx2.example.com.
+example.com.      300 MX    10 mx1.example.com.
+example.com.      300 A     192.0.2.1
+www.example.com.  300 CNAME cdn.example.net.
+cdn.example.net.  300 A     192.0.2.2
+ns1.example.com.  300 A     192.0.2.53
+ns2.example.net.  300 A     198.51.100.53
+ns2.example.net.  300 AAAA  2001:db8::53
+mx1.example.com.  300 A     192.0.2.25
+mx2.example.com.  300 A     192.0.2.26
+`
+
+func Test_scanner_scan(t *testing.T) {
+	r := require.New(t)
+
+	udp := fakeRecursor(t, testRecursorZone, false)
+	s := &scanner{
+		upstreams: testPool(udp),
+		targets:   scanTargets{ns: true, apex: true, www: true, mx: true},
+		nsCache:   newNsCache(16, time.Minute),
+	}
+
+	res := s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"ns1.example.com.", "ns2.example.net."}, res.Nss)
+	r.Equal([]string{"192.0.2.53", "198.51.100.53", "2001:db8::53"}, res.NsAddrs)
+	r.Equal([]string{"mx1.example.com.", "mx2.example.com."}, res.Mxs)
+	r.Equal([]string{"192.0.2.25", "192.0.2.26"}, res.MxAddrs)
+	r.Equal([]string{"192.0.2.1"}, res.ApexAddrs)
+	r.Equal([]string{"192.0.2.2"}, res.WwwAddrs)
+
+	// Name server addresses are cached.
+	n := len(udp.Queries())
+	s.targets = scanTargets{ns: true}
+	res = s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Len(udp.Queries(), n+1)
+
+	// Detail output.
+	s.detail = true
+	res = s.scan(context.Background(), "example.com.")
+	r.Empty(res.Nss)
+	r.Equal([]HostDetail{
+		{Name: "ns1.example.com.", Addrs: []AddrDetail{{Addr: "192.0.2.53"}}},
+		{Name: "ns2.example.net.", Addrs: []AddrDetail{{Addr: "198.51.100.53"}, {Addr: "2001:db8::53"}}},
+	}, res.NsDetail)
+}
+
+func Test_parseTargets(t *testing.T) {
+	r := require.New(t)
+
+	targets, err := parseTargets([]string{targetApex, targetWww})
+	r.NoError(err)
+	r.Equal(scanTargets{apex: true, www: true}, targets)
+	_, err = parseTargets([]string{targetNs, "txt"})
+	r.Error(err)
+	_, err = parseTargets(nil)
+	r.Error(err)
+}
+
+func Test_scanner_scanTargets(t *testing.T) {
+	r := require.New(t)
+
+	// Only addresses of the apex and www are queried.
+	udp := fakeRecursor(t, testRecursorZone, false)
+	s := &scanner{
+		upstreams: testPool(udp),
+		targets:   scanTargets{apex: true, www: true},
+	}
+	res := s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Empty(res.Nss)
+	r.Empty(res.NsAddrs)
+	r.Equal([]string{"192.0.2.1"}, res.ApexAddrs)
+	r.Equal([]string{"192.0.2.2"}, res.WwwAddrs)
+	for _, q := range udp.Queries() {
+		r.Contains([]uint16{dns.TypeA, dns.TypeAAAA}, q.Question.Qtype)
+	}
+
+	// Errors of both hosts and both types are reported.
+	res = s.scan(context.Background(), "example.net.")
+	r.Len(res.Errs, 4)
+	r.Empty(res.ApexAddrs)
+	r.Empty(res.WwwAddrs)
+	for _, e := range res.Errs {
+		r.True(strings.HasPrefix(e, "failed to lookup host "), e)
+	}
+
+	// Name server lookup errors keep their wording.
+	s.upstreams = testPool(fakeRecursor(t, "example.org. 300 NS ns.example.org.\n", false))
+	s.targets = scanTargets{ns: true}
+	res = s.scan(context.Background(), "example.org.")
+	r.Len(res.Errs, 2)
+	for _, e := range res.Errs {
+		r.True(strings.HasPrefix(e, "failed to lookup ns ns.example.org. addr qt="), e)
+	}
+}
+
+func Test_scanner_scanMx(t *testing.T) {
+	r := require.New(t)
+
+	udp := fakeRecursor(t, `
+example.org.      300 MX  50 mx5.example.org.
+example.org.      300 MX  30 mx3.example.org.
+example.org.      300 MX  10 mx1.example.org.
+example.org.      300 MX  40 mx4.example.org.
+example.org.      300 MX  20 mx2.example.org.
+mx1.example.org.  300 A   192.0.2.1
+mx2.example.org.  300 A   192.0.2.2
+mx3.example.org.  300 A   192.0.2.3
+mx4.example.org.  300 A   192.0.2.4
+mx5.example.org.  300 A   192.0.2.5
+example.net.      300 MX  0 .
+`, false)
+	s := &scanner{
+		upstreams: testPool(udp),
+		geoReader: &fakeGeo{countries: map[string]string{"192.0.2.1": "US", "192.0.2.2": "DE"}},
+		targets:   scanTargets{mx: true},
+	}
+
+	// Exchangers are sorted by preference. Only the first 4 are resolved.
+	res := s.scan(context.Background(), "example.org.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"mx1.example.org.", "mx2.example.org.", "mx3.example.org.", "mx4.example.org.", "mx5.example.org."}, res.Mxs)
+	r.Equal([]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}, res.MxAddrs)
+	r.Equal([]string{"DE", "US"}, res.MxLocCodes)
+
+	// Null MX.
+	res = s.scan(context.Background(), "example.net.")
+	r.Empty(res.Errs)
+	r.Empty(res.Mxs)
+	r.Empty(res.MxAddrs)
+}
+
+func Test_scanner_tcpFallback(t *testing.T) {
+	r := require.New(t)
+
+	udp := fakeRecursor(t, testRecursorZone, true)
+	tcp := fakeRecursor(t, testRecursorZone, false)
+	s := &scanner{
+		upstreams: testPool(udp),
+		targets:   scanTargets{apex: true},
+	}
+	s.upstreams.us[0].tcp = tcp
+
+	res := s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"192.0.2.1"}, res.ApexAddrs)
+	r.Equal(2, res.TcpFallbacks) // A and AAAA
+	r.Len(tcp.Queries(), 2)
+}
+
+func Test_scanner_retry(t *testing.T) {
+	r := require.New(t)
+
+	good := fakeRecursor(t, testRecursorZone, false)
+	bad := &dnsClient.Fake{Handler: func(q *dns.Msg, _ netip.AddrPort) (*dns.Msg, error) {
+		return new(dns.Msg).SetRcode(q, dns.RcodeServerFailure), nil
+	}}
+	pool, err := newUpstreamPool(strategyRoundRobin, []*upstream{{name: "bad", ex: bad}, {name: "good", ex: good}})
+	r.NoError(err)
+	s := &scanner{
+		upstreams: pool,
+		targets:   scanTargets{apex: true},
+		retry: retryPolicy{
+			maxAttempts: 2,
+			rcodes:      map[int]struct{}{dns.RcodeServerFailure: {}},
+		},
+	}
+
+	// Queries that went to bad are retried on good.
+	res := s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"192.0.2.1"}, res.ApexAddrs)
+	r.Len(good.Queries(), 2) // A and AAAA
+	r.NotEmpty(bad.Queries())
+	r.Equal(len(good.Queries())+len(bad.Queries()), res.Attempts)
+
+	// Without retries, the SERVFAIL is an error.
+	s.upstreams = testPool(bad)
+	s.retry.maxAttempts = 1
+	res = s.scan(context.Background(), "example.com.")
+	r.NotEmpty(res.Errs)
+	r.Equal(2, res.Attempts)
+}
+
+func Test_scanner_ecs(t *testing.T) {
+	r := require.New(t)
+
+	// The fake recursor answers with the first byte of the subnet.
+	udp := &dnsClient.Fake{Handler: func(q *dns.Msg, _ netip.AddrPort) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.SetEdns0(1200, false)
+		var ecs *dns.EDNS0_SUBNET
+		for _, o := range q.IsEdns0().Option {
+			if v, ok := o.(*dns.EDNS0_SUBNET); ok {
+				ecs = v
+			}
+		}
+		if ecs == nil || q.Question[0].Qtype != dns.TypeA {
+			return resp, nil
+		}
+		resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			SourceScope:   16,
+			Address:       ecs.Address,
+		})
+		rr, err := dns.NewRR(fmt.Sprintf("%s 300 IN A 192.0.2.%d", q.Question[0].Name, ecs.Address.To4()[0]))
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = append(resp.Answer, rr)
+		return resp, nil
+	}}
+	base := &scanner{
+		upstreams: testPool(udp),
+		targets:   scanTargets{apex: true},
+		nsCache:   newNsCache(16, time.Minute),
+	}
+	ecss, err := parseEcsList([]string{"1.2.3.4/24", "5.6.7.0/24"})
+	r.NoError(err)
+	scanners := base.withEcsList(ecss)
+	r.Len(scanners, 2)
+	r.NotSame(scanners[0].nsCache, scanners[1].nsCache)
+
+	res := scanners[0].scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal("1.2.3.0/24", res.Ecs)
+	r.Equal(16, res.EcsScope)
+	r.Equal([]string{"192.0.2.1"}, res.ApexAddrs)
+
+	res = scanners[1].scan(context.Background(), "example.com.")
+	r.Equal("5.6.7.0/24", res.Ecs)
+	r.Equal([]string{"192.0.2.5"}, res.ApexAddrs)
+
+	_, err = parseEcsList([]string{"1.2.3.4"})
+	r.Error(err)
+}
+
+// scanVantages scans fqdn with all scanners of vs and returns the merged result.
+func scanVantages(vs *vantageScanner, fqdn string) (res *Result) {
+	for _, sc := range vs.scanners {
+		res = vs.add(sc.scan(context.Background(), fqdn))
+	}
+	return res
+}
+
+func Test_vantageScanner(t *testing.T) {
+	r := require.New(t)
+
+	// Servers of vantage "b" resolve the apex to a different address.
+	zoneB := strings.Replace(testRecursorZone, "192.0.2.1\n", "203.0.113.1\n", 1)
+	recA, recB := fakeRecursor(t, testRecursorZone, false), fakeRecursor(t, zoneB, false)
+	tr := &dnsClient.Fake{Handler: func(q *dns.Msg, addr netip.AddrPort) (*dns.Msg, error) {
+		switch addr.Addr().String() {
+		case "127.0.0.1":
+			return recA.Handler(q, addr)
+		case "127.0.0.2":
+			return recB.Handler(q, addr)
+		default:
+			return new(dns.Msg).SetRcode(q, dns.RcodeRefused), nil
+		}
+	}}
+	opts := upstreamOpts{udp: tr, tcp: tr}
+	_, err := parseVantages([]string{"127.0.0.1:53"}, strategyRandom, opts)
+	r.Error(err)
+	vantages, err := parseVantages([]string{"a=127.0.0.1:53", "b=127.0.0.2:53", "a=127.0.0.1:5353"}, strategyRandom, opts)
+	r.NoError(err)
+	r.Len(vantages, 2)
+	r.Len(vantages[0].pool.us, 2)
+
+	base := &scanner{targets: scanTargets{ns: true, apex: true}, nsCache: newNsCache(16, time.Minute)}
+	vs := base.withVantages(vantages)
+	r.Nil(vs.add(vs.scanners[0].scan(context.Background(), "example.com.")))
+	res := vs.add(vs.scanners[1].scan(context.Background(), "example.com."))
+	r.NotNil(res)
+	r.Empty(vs.pending)
+	r.Empty(res.Errs)
+	r.Equal(res.Vantages[0].Attempts+res.Vantages[1].Attempts, res.Attempts)
+	r.NotZero(res.Attempts)
+	r.Equal(res.Vantages[0].TcpFallbacks+res.Vantages[1].TcpFallbacks, res.TcpFallbacks)
+	r.True(res.VantageDiff)
+	r.Len(res.Vantages, 2)
+	r.Equal("a", res.Vantages[0].Vantage)
+	r.Empty(res.Vantages[0].Fqdn)
+	r.Equal([]string{"192.0.2.1"}, res.Vantages[0].ApexAddrs)
+	r.Equal([]string{"203.0.113.1"}, res.Vantages[1].ApexAddrs)
+	r.Equal(res.Vantages[0].Nss, res.Vantages[1].Nss)
+
+	// Same answers.
+	base.targets = scanTargets{ns: true}
+	res = scanVantages(base.withVantages(vantages), "example.com.")
+	r.Empty(res.Errs)
+	r.False(res.VantageDiff)
+
+	// Failed vantages are not compared.
+	vantages = append(vantages, &vantage{name: "c", pool: testPool(tr.Exchanger(netip.MustParseAddrPort("127.0.0.3:53")))})
+	base.targets = scanTargets{apex: true}
+	res = scanVantages(base.withVantages(vantages[1:]), "example.com.")
+	r.NotEmpty(res.Errs)
+	r.True(strings.HasPrefix(res.Errs[0], "c: "))
+	r.False(res.VantageDiff)
+}
+
+func Test_scanner_glue(t *testing.T) {
+	r := require.New(t)
+
+	// NS responses have glue that is different from the looked up addresses.
+	rec := fakeRecursor(t, testRecursorZone+"foo.net. 300 NS ns2.example.net.\n", false)
+	glue := parseZone(t, `
+ns1.example.com.  300 A 203.0.113.10
+ns2.example.net.  300 A 203.0.113.2
+`)
+	udp := &dnsClient.Fake{Handler: func(q *dns.Msg, addr netip.AddrPort) (*dns.Msg, error) {
+		resp, err := rec.Handler(q, addr)
+		if err == nil && q.Question[0].Qtype == dns.TypeNS {
+			resp.Extra = append(resp.Extra, glue...)
+		}
+		return resp, err
+	}}
+	s := &scanner{
+		upstreams: testPool(udp),
+		targets:   scanTargets{ns: true},
+	}
+
+	res := s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"192.0.2.53", "198.51.100.53", "2001:db8::53"}, res.NsAddrs)
+	r.Empty(res.NsGlueAddrs)
+
+	s.glue = glueAll
+	res = s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"203.0.113.10", "203.0.113.2"}, res.NsAddrs)
+	r.Equal(res.NsAddrs, res.NsGlueAddrs) // In the same order.
+
+	// Only glue of ns1.example.com. is in the bailiwick of com.
+	s.glue = glueBailiwick
+	res = s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"198.51.100.53", "2001:db8::53", "203.0.113.10"}, res.NsAddrs)
+	r.Equal([]string{"203.0.113.10"}, res.NsGlueAddrs)
+
+	// Sibling glue ns2.example.net. is in the bailiwick of net.
+	res = s.scan(context.Background(), "foo.net.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"203.0.113.2"}, res.NsGlueAddrs)
+
+	// Only glue of ns1.example.com. is in-domain.
+	s.glue = glueDomain
+	res = s.scan(context.Background(), "example.com.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"198.51.100.53", "2001:db8::53", "203.0.113.10"}, res.NsAddrs)
+	r.Equal([]string{"203.0.113.10"}, res.NsGlueAddrs)
+	res = s.scan(context.Background(), "foo.net.")
+	r.Empty(res.Errs)
+	r.Equal([]string{"198.51.100.53", "2001:db8::53"}, res.NsAddrs)
+	r.Empty(res.NsGlueAddrs)
+}
@@ -0,0 +1,46 @@
+package scan
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// scanStats counts events during the scan of one domain.
+type scanStats struct {
+	tcpFallbacks atomic.Int32
+	attempts     atomic.Int32 // Queries sent to upstreams.
+	ecsScope     atomic.Int32 // The largest ecs scope prefix length.
+}
+
+type scanStatsKey struct{}
+
+func withScanStats(ctx context.Context) (context.Context, *scanStats) {
+	st := new(scanStats)
+	return context.WithValue(ctx, scanStatsKey{}, st), st
+}
+
+// scanStatsFrom returns the scanStats in ctx. It returns nil if there is none.
+func scanStatsFrom(ctx context.Context) *scanStats {
+	st, _ := ctx.Value(scanStatsKey{}).(*scanStats)
+	return st
+}
+
+// maxEcsScope sets the ecs scope to scope if it is larger.
+func (st *scanStats) maxEcsScope(scope int32) {
+	for {
+		cur := st.ecsScope.Load()
+		if scope <= cur || st.ecsScope.CompareAndSwap(cur, scope) {
+			return
+		}
+	}
+}
+
+// add adds counters of o to st. st and o can be nil.
+func (st *scanStats) add(o *scanStats) {
+	if st == nil || o == nil {
+		return
+	}
+	st.tcpFallbacks.Add(o.tcpFallbacks.Load())
+	st.attempts.Add(o.attempts.Load())
+	st.maxEcsScope(o.ecsScope.Load())
+}
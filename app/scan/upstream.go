@@ -0,0 +1,154 @@
+package scan
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	dnsClient "github.com/IrineSistiana/nsloc/pkg/dns_client"
+)
+
+// upstream is a recursive server that the scanner sends queries to.
+type upstream struct {
+	name string
+	ex   dnsClient.Exchanger
+	tcp  dnsClient.Exchanger // Optional. Truncated responses from ex will be queried again through it.
+
+	weight    int             // For the weighted strategy.
+	transport *http.Transport // Optional. The DoH transport that is only used by this upstream.
+	health    upstreamHealth
+}
+
+// minStreamIdleTimeout is the minimum idle timeout of TCP and DoT connections.
+const minStreamIdleTimeout = time.Second * 10
+
+type upstreamOpts struct {
+	udp, tcp      dnsClient.Transport // For plain dns.
+	tlsConfig     *tls.Config         // For DoT and DoH. Shared and read-only.
+	httpTransport *http.Transport     // For DoH. Shared by all DoH upstreams.
+	dohGet        bool
+	timeout       time.Duration // Query timeout of DoT and DoH.
+	idleTimeout   time.Duration // Idle timeout of DoT connections.
+}
+
+func (u *upstream) close() {
+	if c, ok := u.ex.(io.Closer); ok {
+		c.Close()
+	}
+	if u.transport != nil {
+		u.transport.CloseIdleConnections()
+	}
+}
+
+// parseUpstream parses an upstream. Supported formats are:
+// "ip:port", "udp://ip:port", "tls://host[:port]", "https://host[:port]/path".
+// tls and https upstreams can have a "sni" query parameter.
+// All formats can have a "#weight" suffix.
+func parseUpstream(s string, opts upstreamOpts) (*upstream, error) {
+	s, weight, err := cutWeight(s)
+	if err != nil {
+		return nil, err
+	}
+	u, err := newUpstream(s, opts)
+	if err != nil {
+		return nil, err
+	}
+	u.weight = weight
+	return u, nil
+}
+
+func newUpstream(s string, opts upstreamOpts) (*upstream, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		ap, err := netip.ParseAddrPort(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &upstream{name: s, ex: opts.udp.Exchanger(ap), tcp: opts.tcp.Exchanger(ap)}, nil
+	case "tls":
+		host := u.Host
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), "853")
+		}
+		c := dnsClient.NewTLS(host, upstreamTLSConfig(u, opts.tlsConfig))
+		c.Timeout = opts.timeout
+		c.IdleTimeout = opts.idleTimeout
+		return &upstream{name: s, ex: c}, nil
+	case "https":
+		up := &upstream{name: s}
+		transport := opts.httpTransport
+		if conf := upstreamTLSConfig(u, opts.tlsConfig); conf != opts.tlsConfig {
+			// The server name can't be changed on a shared transport.
+			transport = opts.httpTransport.Clone()
+			transport.TLSClientConfig = conf
+			up.transport = transport
+		}
+		c, err := dnsClient.NewHTTPS(u.String(), transport, opts.dohGet)
+		if err != nil {
+			return nil, err
+		}
+		c.Timeout = opts.timeout
+		up.ex = c
+		return up, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+}
+
+// upstreamTLSConfig cuts the "sni" query parameter of u. If it exists,
+// a copy of base with the server name will be returned. Otherwise, base
+// will be returned.
+func upstreamTLSConfig(u *url.URL, base *tls.Config) *tls.Config {
+	query := u.Query()
+	sni := query.Get("sni")
+	if !query.Has("sni") {
+		return base
+	}
+	query.Del("sni")
+	u.RawQuery = query.Encode()
+	if len(sni) == 0 {
+		return base
+	}
+	conf := base.Clone()
+	if conf == nil {
+		conf = new(tls.Config)
+	}
+	conf.ServerName = sni
+	return conf
+}
+
+// newTLSConfig creates the tls config of encrypted upstreams. All args are optional.
+func newTLSConfig(caFp string, insecure bool) (*tls.Config, error) {
+	conf := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if len(caFp) > 0 {
+		b, err := os.ReadFile(caFp)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no valid certificate in ca file")
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
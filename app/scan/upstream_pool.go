@@ -0,0 +1,194 @@
+package scan
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Upstream selection strategies.
+const (
+	strategyRandom        = "random"
+	strategyRoundRobin    = "round-robin"
+	strategyWeighted      = "weighted"
+	strategyLowestLatency = "lowest-latency"
+)
+
+const (
+	ejectAfterFails  = 5                // Consecutive failures that eject an upstream.
+	minEjectDuration = time.Second * 10 // Doubled on every consecutive ejection.
+	maxEjectDuration = time.Minute * 5
+	failurePenalty   = time.Second * 5 // A failure counts as a query with this latency.
+	latencyEwmaAlpha = 0.1
+	exploreRate      = 0.05 // Rate of lowest-latency queries that go to a random upstream.
+)
+
+// upstreamHealth tracks the health of an upstream.
+type upstreamHealth struct {
+	queries   atomic.Uint64
+	failures  atomic.Uint64
+	ejections atomic.Uint64
+
+	m                sync.Mutex
+	latency          time.Duration // ewma of latencies, failures count as failurePenalty.
+	consecutiveFails int
+	ejectCount       int // Consecutive ejections.
+	ejectedUntil     time.Time
+}
+
+func (h *upstreamHealth) ejected(now time.Time) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return now.Before(h.ejectedUntil)
+}
+
+func (h *upstreamHealth) score() time.Duration {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.latency
+}
+
+func (h *upstreamHealth) report(latency time.Duration, ok bool) {
+	h.queries.Add(1)
+	if !ok {
+		h.failures.Add(1)
+		latency = failurePenalty
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency = time.Duration(latencyEwmaAlpha*float64(latency) + (1-latencyEwmaAlpha)*float64(h.latency))
+	}
+
+	if ok {
+		h.consecutiveFails = 0
+		h.ejectCount = 0
+		return
+	}
+	h.consecutiveFails++
+	now := time.Now()
+	// An upstream that was just re-admitted will be ejected again on its first failure.
+	if h.consecutiveFails >= ejectAfterFails || (h.ejectCount > 0 && now.After(h.ejectedUntil)) {
+		d := minEjectDuration << min(h.ejectCount, 10)
+		h.ejectedUntil = now.Add(min(d, maxEjectDuration))
+		h.ejectCount++
+		h.consecutiveFails = 0
+		h.ejections.Add(1)
+	}
+}
+
+// upstreamPool selects upstreams with a strategy. Upstreams that keep
+// failing will be ejected temporarily.
+type upstreamPool struct {
+	strategy string
+	us       []*upstream
+	rr       atomic.Uint32
+}
+
+func newUpstreamPool(strategy string, us []*upstream) (*upstreamPool, error) {
+	switch strategy {
+	case strategyRandom, strategyRoundRobin, strategyWeighted, strategyLowestLatency:
+	default:
+		return nil, fmt.Errorf("invalid strategy %s", strategy)
+	}
+	return &upstreamPool{strategy: strategy, us: us}, nil
+}
+
+// pick selects an upstream other than exclude. exclude can be nil.
+// If all other upstreams are ejected, all of them will be candidates.
+// exclude will be picked only if it is the only upstream.
+func (p *upstreamPool) pick(exclude *upstream) *upstream {
+	if len(p.us) == 1 {
+		return p.us[0]
+	}
+
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(p.us))
+	others := make([]*upstream, 0, len(p.us))
+	for _, u := range p.us {
+		if u == exclude {
+			continue
+		}
+		others = append(others, u)
+		if !u.health.ejected(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = others
+	}
+
+	switch p.strategy {
+	case strategyRoundRobin:
+		return candidates[(p.rr.Add(1)-1)%uint32(len(candidates))]
+	case strategyWeighted:
+		total := 0
+		for _, u := range candidates {
+			total += u.weight
+		}
+		n := rand.Intn(total)
+		for _, u := range candidates {
+			if n -= u.weight; n < 0 {
+				return u
+			}
+		}
+		return candidates[len(candidates)-1]
+	case strategyLowestLatency:
+		if rand.Float64() < exploreRate {
+			return candidates[rand.Intn(len(candidates))]
+		}
+		best := candidates[0]
+		bestScore := best.health.score()
+		for _, u := range candidates[1:] {
+			if s := u.health.score(); s < bestScore {
+				best, bestScore = u, s
+			}
+		}
+		return best
+	default:
+		return candidates[rand.Intn(len(candidates))]
+	}
+}
+
+// report records the result of a query to u. Errors, SERVFAIL and REFUSED
+// are failures.
+func (p *upstreamPool) report(u *upstream, latency time.Duration, resp *dns.Msg, err error) {
+	ok := err == nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+	u.health.report(latency, ok)
+}
+
+func (p *upstreamPool) logStats() {
+	for _, u := range p.us {
+		h := &u.health
+		logger.Info("upstream stats",
+			zap.String("upstream", u.name),
+			zap.Uint64("queries", h.queries.Load()),
+			zap.Uint64("failures", h.failures.Load()),
+			zap.Uint64("ejections", h.ejections.Load()),
+			zap.Duration("latency_ewma", h.score()),
+		)
+	}
+}
+
+// cutWeight cuts the "#weight" suffix of an upstream.
+func cutWeight(s string) (string, int, error) {
+	i := strings.LastIndexByte(s, '#')
+	if i < 0 {
+		return s, 1, nil
+	}
+	w, err := strconv.Atoi(s[i+1:])
+	if err != nil || w <= 0 {
+		return "", 0, fmt.Errorf("invalid weight %s", s[i+1:])
+	}
+	return s[:i], w, nil
+}
@@ -0,0 +1,81 @@
+package scan
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cutWeight(t *testing.T) {
+	r := require.New(t)
+	s, w, err := cutWeight("8.8.8.8:53#3")
+	r.NoError(err)
+	r.Equal("8.8.8.8:53", s)
+	r.Equal(3, w)
+
+	s, w, err = cutWeight("https://dns.google/dns-query")
+	r.NoError(err)
+	r.Equal("https://dns.google/dns-query", s)
+	r.Equal(1, w)
+
+	_, _, err = cutWeight("8.8.8.8:53#0")
+	r.Error(err)
+}
+
+func Test_upstreamPool(t *testing.T) {
+	r := require.New(t)
+	a, b := &upstream{name: "a", weight: 1}, &upstream{name: "b", weight: 1}
+	p, err := newUpstreamPool(strategyRoundRobin, []*upstream{a, b})
+	r.NoError(err)
+	r.Equal(a, p.pick(nil))
+	r.Equal(b, p.pick(nil))
+	r.Equal(b, p.pick(a))
+	r.Equal(b, p.pick(a))
+
+	// The counter is larger than the max int32 (int on 32-bit platforms).
+	p.rr.Store(1 << 31)
+	r.Equal(a, p.pick(nil))
+	r.Equal(b, p.pick(nil))
+
+	// a keeps failing and will be ejected.
+	for i := 0; i < ejectAfterFails; i++ {
+		p.report(a, time.Millisecond, nil, errors.New("timeout"))
+	}
+	for i := 0; i < 4; i++ {
+		r.Equal(b, p.pick(nil))
+	}
+	r.EqualValues(1, a.health.ejections.Load())
+
+	// a is re-admitted after the ejection and will be ejected again on its first failure.
+	a.health.ejectedUntil = time.Now().Add(-time.Millisecond)
+	r.False(a.health.ejected(time.Now()))
+	p.report(a, time.Millisecond, new(dns.Msg).SetRcode(new(dns.Msg), dns.RcodeServerFailure), nil)
+	r.True(a.health.ejected(time.Now()))
+	r.EqualValues(2, a.health.ejections.Load())
+
+	// All upstreams are ejected, pick from all of them.
+	for i := 0; i < ejectAfterFails; i++ {
+		p.report(b, time.Millisecond, nil, errors.New("timeout"))
+	}
+	r.NotNil(p.pick(nil))
+
+	// lowest-latency prefers the upstream with the lower score.
+	c, d := &upstream{name: "c"}, &upstream{name: "d"}
+	c.health.report(time.Millisecond*100, true)
+	d.health.report(time.Millisecond*10, true)
+	p, err = newUpstreamPool(strategyLowestLatency, []*upstream{c, d})
+	r.NoError(err)
+	picked := 0
+	for i := 0; i < 100; i++ {
+		if p.pick(nil) == d {
+			picked++
+		}
+	}
+	r.Greater(picked, 80)
+
+	_, err = newUpstreamPool("fastest", []*upstream{c})
+	r.Error(err)
+}
@@ -0,0 +1,54 @@
+package scan
+
+import (
+	"crypto/tls"
+	"net/url"
+	"testing"
+
+	dnsClient "github.com/IrineSistiana/nsloc/pkg/dns_client"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseUpstream_sni(t *testing.T) {
+	r := require.New(t)
+
+	base := &tls.Config{InsecureSkipVerify: true}
+	opts := upstreamOpts{tlsConfig: base, httpTransport: dnsClient.NewHTTPTransport(base)}
+
+	// Upstreams without sni share the transport.
+	u, err := parseUpstream("https://192.0.2.1/dns-query?x=1#2", opts)
+	r.NoError(err)
+	r.Nil(u.transport)
+	r.Equal(2, u.weight)
+
+	u, err = parseUpstream("https://192.0.2.1/dns-query?sni=dns.example&x=1", opts)
+	r.NoError(err)
+	r.NotNil(u.transport)
+	r.Equal("dns.example", u.transport.TLSClientConfig.ServerName)
+	r.True(u.transport.TLSClientConfig.InsecureSkipVerify)
+	r.Empty(base.ServerName)
+	u.close()
+
+	_, err = parseUpstream("tls://192.0.2.1?sni=dns.example", opts)
+	r.NoError(err)
+}
+
+func Test_upstreamTLSConfig(t *testing.T) {
+	r := require.New(t)
+
+	base := new(tls.Config)
+	u, err := url.Parse("https://192.0.2.1/dns-query?x=1&sni=a.example")
+	r.NoError(err)
+	conf := upstreamTLSConfig(u, base)
+	r.Equal("a.example", conf.ServerName)
+	r.Empty(base.ServerName)
+	r.Equal("https://192.0.2.1/dns-query?x=1", u.String())
+
+	u, err = url.Parse("tls://192.0.2.1:853")
+	r.NoError(err)
+	r.Same(base, upstreamTLSConfig(u, base))
+
+	u, err = url.Parse("tls://192.0.2.1?sni=b.example")
+	r.NoError(err)
+	r.Equal("b.example", upstreamTLSConfig(u, nil).ServerName)
+}
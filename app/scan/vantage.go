@@ -0,0 +1,179 @@
+package scan
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// vantage is a named group of upstreams that domains are scanned through.
+type vantage struct {
+	name string
+	pool *upstreamPool
+}
+
+// parseVantages parses "name=upstream" args. Upstreams with the same name
+// are in the same group. Vantages are in the order of their first appearance.
+func parseVantages(ss []string, strategy string, opts upstreamOpts) ([]*vantage, error) {
+	var names []string
+	groups := make(map[string][]*upstream)
+	for _, s := range ss {
+		name, u, ok := strings.Cut(s, "=")
+		if !ok || len(name) == 0 || len(u) == 0 {
+			return nil, fmt.Errorf("invalid vantage %s, want name=upstream", s)
+		}
+		up, err := parseUpstream(u, opts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream of vantage %s, %w", s, err)
+		}
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], up)
+	}
+
+	vs := make([]*vantage, 0, len(names))
+	for _, name := range names {
+		pool, err := newUpstreamPool(strategy, groups[name])
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, &vantage{name: name, pool: pool})
+	}
+	return vs, nil
+}
+
+func (v *vantage) close() {
+	for _, u := range v.pool.us {
+		u.close()
+	}
+}
+
+// vantageScanner has a copy of the scanner for each vantage. Domains are
+// scanned by each copy in separate jobs, so --sps and --cc apply
+// to each scan. Results of a domain are merged by add.
+type vantageScanner struct {
+	names    []string
+	scanners []*scanner
+
+	pending map[string][]*Result // fqdn -> results by vantage. Not safe for concurrent use.
+}
+
+// withVantages returns a vantageScanner that has a copy of s for each of vs.
+// Each copy has its own ns cache, because addresses depend on the vantage.
+func (s *scanner) withVantages(vs []*vantage) *vantageScanner {
+	vsc := &vantageScanner{pending: make(map[string][]*Result)}
+	for _, v := range vs {
+		sc := *s
+		sc.upstreams = v.pool
+		sc.vantage = v.name
+		if s.nsCache != nil {
+			sc.nsCache = newNsCache(s.nsCache.size, s.nsCache.timeout)
+		}
+		vsc.names = append(vsc.names, v.name)
+		vsc.scanners = append(vsc.scanners, &sc)
+	}
+	return vsc
+}
+
+// add adds the result of a vantage. If results of all vantages of the
+// domain were added, it returns the merged result. Otherwise, nil.
+func (vs *vantageScanner) add(r *Result) *Result {
+	i := slices.Index(vs.names, r.Vantage)
+	if i < 0 {
+		return r // Not from a vantage.
+	}
+	rs := vs.pending[r.Fqdn]
+	if rs == nil {
+		rs = make([]*Result, len(vs.names))
+		vs.pending[r.Fqdn] = rs
+	}
+	rs[i] = r
+	for _, vr := range rs {
+		if vr == nil {
+			return nil
+		}
+	}
+	delete(vs.pending, r.Fqdn)
+	return mergeVantages(r.Fqdn, rs)
+}
+
+// mergeVantages merges results of vantages of fqdn. Errors of vantages are
+// moved to r.Errs with the vantage name as prefix. Only vantages without
+// errors are compared. Counters are summed, and the elapsed time is the
+// longest one.
+func mergeVantages(fqdn string, vrs []*Result) (r *Result) {
+	r = new(Result)
+	r.Fqdn = fqdn
+	r.Vantages = vrs
+
+	var okResults []*Result
+	for _, vr := range vrs {
+		vr.Fqdn = ""
+		r.ElapsedMs = max(r.ElapsedMs, vr.ElapsedMs)
+		r.Attempts += vr.Attempts
+		r.TcpFallbacks += vr.TcpFallbacks
+		if len(vr.Errs) > 0 {
+			for _, err := range vr.Errs {
+				r.Errs = append(r.Errs, vr.Vantage+": "+err)
+			}
+			vr.Errs = nil
+			continue
+		}
+		okResults = append(okResults, vr)
+	}
+	for _, vr := range okResults[min(1, len(okResults)):] {
+		if !slices.EqualFunc(answerSets(okResults[0]), answerSets(vr), slices.Equal[[]string]) {
+			r.VantageDiff = true
+			break
+		}
+	}
+	return r
+}
+
+// answerSets returns sorted sets of names, addresses and locations in r,
+// from either flat fields or --detail fields.
+func answerSets(r *Result) [][]string {
+	var sets [][]string
+	add := func(ss ...[]string) {
+		for _, s := range ss {
+			s = slices.Clone(s)
+			for i := range s {
+				s[i] = strings.ToLower(s[i])
+			}
+			slices.Sort(s)
+			sets = append(sets, slices.Compact(s))
+		}
+	}
+
+	nsNames, nsAddrs, nsLocs := hostDetailSets(r.NsDetail)
+	add(append(nsNames, r.Nss...), append(nsAddrs, r.NsAddrs...), append(nsLocs, r.LocCodes...))
+	mxNames, mxAddrs, mxLocs := hostDetailSets(r.MxDetail)
+	add(append(mxNames, r.Mxs...), append(mxAddrs, r.MxAddrs...), append(mxLocs, r.MxLocCodes...))
+	apexAddrs, apexLocs := addrDetailSets(r.ApexDetail)
+	add(append(apexAddrs, r.ApexAddrs...), append(apexLocs, r.ApexLocCodes...))
+	wwwAddrs, wwwLocs := addrDetailSets(r.WwwDetail)
+	add(append(wwwAddrs, r.WwwAddrs...), append(wwwLocs, r.WwwLocCodes...))
+	return sets
+}
+
+func hostDetailSets(hs []HostDetail) (names, addrs, locs []string) {
+	for _, h := range hs {
+		names = append(names, h.Name)
+		a, l := addrDetailSets(h.Addrs)
+		addrs = append(addrs, a...)
+		locs = append(locs, l...)
+	}
+	return names, addrs, locs
+}
+
+func addrDetailSets(as []AddrDetail) (addrs, locs []string) {
+	for _, a := range as {
+		addrs = append(addrs, a.Addr)
+		if len(a.Country) > 0 {
+			locs = append(locs, a.Country)
+		}
+	}
+	return addrs, locs
+}
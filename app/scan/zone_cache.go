@@ -0,0 +1,73 @@
+package scan
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+const maxZoneCacheSize = 1 << 16
+
+// zoneCache caches name server addresses of zones. Zone names are
+// case-insensitive.
+type zoneCache struct {
+	m     sync.RWMutex
+	zones map[string]zoneEntry
+}
+
+type zoneEntry struct {
+	addrs  []netip.Addr
+	expire time.Time
+}
+
+func newZoneCache() *zoneCache {
+	return &zoneCache{zones: make(map[string]zoneEntry)}
+}
+
+// get returns cached servers of zone.
+func (c *zoneCache) get(zone string) []netip.Addr {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if e, ok := c.zones[strings.ToLower(zone)]; ok && time.Now().Before(e.expire) {
+		return e.addrs
+	}
+	return nil
+}
+
+// closest returns the closest cached zone of name and its servers.
+// If no zone was found, servers will be empty.
+func (c *zoneCache) closest(name string) (zone string, servers []netip.Addr) {
+	name = strings.ToLower(name)
+	now := time.Now()
+	c.m.RLock()
+	defer c.m.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		z := name[off:]
+		if e, ok := c.zones[z]; ok && now.Before(e.expire) {
+			return z, e.addrs
+		}
+	}
+	return "", nil
+}
+
+// store caches addrs of zone. Duplicated addresses are removed.
+func (c *zoneCache) store(zone string, addrs []netip.Addr, ttl uint32) {
+	addrs = slices.Clone(addrs)
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	addrs = slices.Compact(addrs)
+	zone = strings.ToLower(zone)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if len(c.zones) >= maxZoneCacheSize {
+		for z := range c.zones { // Evict a random entry.
+			delete(c.zones, z)
+			break
+		}
+	}
+	c.zones[zone] = zoneEntry{addrs: addrs, expire: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
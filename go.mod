@@ -12,6 +12,7 @@ require (
 	go.uber.org/zap v1.26.0
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d
 	golang.org/x/net v0.16.0
+	golang.org/x/sync v0.4.0
 	golang.org/x/time v0.3.0
 )
 
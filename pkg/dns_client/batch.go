@@ -0,0 +1,113 @@
+package dnsClient
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Maximum number of packets of one read or write syscall. Each socket
+// has batchSize read buffers of udpReadBufSize.
+const batchSize = 64
+
+// batchConn reads and writes multiple packets in one syscall
+// (recvmmsg/sendmmsg). It is only available on linux, see newBatchConn.
+// readBatch and writeBatch can be called concurrently, but each of them
+// must not be called concurrently with itself.
+type batchConn interface {
+	// readBatch reads at most len(bufs) packets. For each packet i, its size
+	// and source are stored in sizes[i] and froms[i]. Truncated packets have
+	// size -1. bufs must be the same in every call.
+	readBatch(bufs [][]byte, sizes []int, froms []netip.AddrPort) (int, error)
+	// writeBatch writes packets in order. It returns the number of packets
+	// that were written. If n < len(ps), err is not nil.
+	writeBatch(ps []*outPacket) (n int, err error)
+}
+
+// outPacket is a packet in the send queue of a socket.
+type outPacket struct {
+	b    []byte
+	addr netip.AddrPort
+	done chan error // Buffered. Receives the result of the write.
+}
+
+func (c *Client) readLoopBatch(s *udpSocket) {
+	defer close(s.closed)
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, udpReadBufSize)
+	}
+	sizes := make([]int, batchSize)
+	froms := make([]netip.AddrPort, batchSize)
+	for {
+		n, err := s.bc.readBatch(bufs, sizes, froms)
+		if err != nil {
+			if !s.retired.Load() {
+				c.closeWithErr(err)
+			}
+			return
+		}
+		for i := 0; i < n; i++ {
+			if sizes[i] < 0 {
+				c.malformed.Add(1)
+				continue
+			}
+			c.handlePacket(bufs[i][:sizes[i]], froms[i])
+		}
+	}
+}
+
+// writeLoop coalesces queued packets of s and writes them with one syscall.
+// It exits when s is closed.
+func (c *Client) writeLoop(s *udpSocket) {
+	ps := make([]*outPacket, 0, batchSize)
+	for {
+		select {
+		case p := <-s.sendQ:
+			ps = append(ps, p)
+		case <-s.closed:
+			return
+		}
+	collect:
+		for len(ps) < batchSize {
+			select {
+			case p := <-s.sendQ:
+				ps = append(ps, p)
+			default:
+				break collect
+			}
+		}
+
+		flushBatch(s.bc, ps)
+		for i := range ps {
+			ps[i] = nil
+		}
+		ps = ps[:0]
+	}
+}
+
+// flushBatch writes ps through bc and reports the result of each packet.
+// Packets that were written before an error succeed.
+func flushBatch(bc batchConn, ps []*outPacket) {
+	n, err := bc.writeBatch(ps)
+	for i, p := range ps {
+		if i < n {
+			p.done <- nil
+		} else {
+			p.done <- err
+		}
+	}
+}
+
+// enqueue sends b through the send queue of s and waits for the result.
+func (s *udpSocket) enqueue(b []byte, addr netip.AddrPort) (int, error) {
+	p := &outPacket{b: b, addr: addr, done: make(chan error, 1)}
+	select {
+	case s.sendQ <- p: // Unbuffered, p is owned by writeLoop now.
+	case <-s.closed:
+		return 0, net.ErrClosed
+	}
+	if err := <-p.done; err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
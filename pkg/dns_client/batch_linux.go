@@ -0,0 +1,99 @@
+//go:build linux
+
+package dnsClient
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchRW is implemented by ipv4.PacketConn and ipv6.PacketConn.
+// ipv4.Message and ipv6.Message are the same type.
+type batchRW interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type linuxBatchConn struct {
+	rw  batchRW
+	rms []ipv4.Message
+	wms []ipv4.Message
+}
+
+// newBatchConn returns a batchConn of c.
+func newBatchConn(c *net.UDPConn) batchConn {
+	var rw batchRW
+	if la, ok := c.LocalAddr().(*net.UDPAddr); ok && la.IP.To4() != nil {
+		rw = ipv4.NewPacketConn(c)
+	} else {
+		// Dual stack socket. Linux accepts ipv4 destinations on it.
+		rw = ipv6.NewPacketConn(c)
+	}
+	bc := &linuxBatchConn{
+		rw:  rw,
+		rms: make([]ipv4.Message, batchSize),
+		wms: make([]ipv4.Message, batchSize),
+	}
+	for i := range bc.wms {
+		bc.wms[i].Buffers = make([][]byte, 1)
+	}
+	return bc
+}
+
+func (bc *linuxBatchConn) readBatch(bufs [][]byte, sizes []int, froms []netip.AddrPort) (int, error) {
+	ms := bc.rms[:min(len(bufs), len(bc.rms))]
+	for i := range ms {
+		if ms[i].Buffers == nil {
+			ms[i].Buffers = [][]byte{bufs[i]}
+		}
+	}
+	n, err := bc.rw.ReadBatch(ms, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		m := &ms[i]
+		if m.Flags&syscall.MSG_TRUNC != 0 {
+			sizes[i] = -1
+			continue
+		}
+		sizes[i] = m.N
+		if ua, ok := m.Addr.(*net.UDPAddr); ok {
+			froms[i] = ua.AddrPort()
+		} else {
+			froms[i] = netip.AddrPort{}
+		}
+	}
+	return n, nil
+}
+
+func (bc *linuxBatchConn) writeBatch(ps []*outPacket) (int, error) {
+	sent := 0
+	for sent < len(ps) {
+		ms := bc.wms[:min(len(ps)-sent, len(bc.wms))]
+		for i := range ms {
+			ms[i].Buffers[0] = ps[sent+i].b
+			ms[i].Addr = net.UDPAddrFromAddrPort(ps[sent+i].addr)
+		}
+		n, err := bc.rw.WriteBatch(ms, 0)
+		for i := range ms {
+			ms[i].Buffers[0] = nil
+			ms[i].Addr = nil
+		}
+		if n > 0 {
+			sent += n
+		}
+		if err != nil {
+			return sent, err
+		}
+		if n <= 0 {
+			return sent, io.ErrShortWrite
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dnsClient
+
+import "net"
+
+// newBatchConn returns nil. Batched I/O is only available on linux.
+func newBatchConn(c *net.UDPConn) batchConn {
+	return nil
+}
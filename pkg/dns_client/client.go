@@ -19,11 +19,47 @@ var (
 	ErrInvalidQuestion = errors.New("invalid question")
 )
 
+const (
+	defaultTimeout            = time.Second * 5
+	defaultRetransmitInterval = time.Second
+	udpReadBufSize            = 65535
+)
+
 type Client struct {
-	c *net.UDPConn
+	// Timeout is the maximum time of a query. Default is 5s.
+	Timeout time.Duration
+	// RetransmitInterval is the time that the query will be sent again
+	// if no response was received. Default is 1s.
+	RetransmitInterval time.Duration
+	// RetransmitBackoff multiplies the interval after every retransmit.
+	// Values <= 1 keep the interval constant.
+	RetransmitBackoff float64
+	// CaseRandomization randomizes the case of qnames (DNS 0x20). Responses
+	// must echo the qname exactly, otherwise they will be dropped.
+	// Names in the returned response will be restored.
+	CaseRandomization bool
+	// Cookies enables DNS cookies (RFC 7873) for queries that have an OPT
+	// record. A client cookie is generated for each server, and its server
+	// cookie will be learned from responses and echoed. Responses with a
+	// wrong client cookie are dropped. Queries that failed with BADCOOKIE
+	// will be sent again once with the new server cookie.
+	Cookies bool
+
+	batch    bool // Use batched I/O if it is available.
+	sm       sync.RWMutex
+	socks    []*udpSocket
+	nextSock atomic.Uint32
 
 	m     sync.Mutex
-	queue map[queryTuple]chan Resp // queue that waiting for response
+	queue map[queryTuple]pendingQuery // queue that waiting for response
+
+	malformed atomic.Uint64
+	unmatched atomic.Uint64
+	badSource atomic.Uint64
+	badCookie atomic.Uint64
+	noCookie  atomic.Uint64
+
+	cookies *cookieJar
 
 	closeOnce   sync.Once
 	closeNotify chan struct{}
@@ -37,18 +73,133 @@ type Resp struct {
 	Msg  *dns.Msg
 }
 
+type pendingQuery struct {
+	c    chan Resp
+	addr netip.AddrPort // Responses from other addresses are dropped.
+}
+
+type udpSocket struct {
+	c       *net.UDPConn
+	retired atomic.Bool   // Closed by rotation, not by errors.
+	closed  chan struct{} // Closed when the read loop exits.
+
+	bc    batchConn       // Nil if batched I/O is unavailable.
+	sendQ chan *outPacket // Unbuffered. Only available with bc.
+}
+
 type queryTuple struct {
 	id       uint16
 	question dns.Question
 }
 
+// New creates a Client that sends queries through c.
 func New(c *net.UDPConn) *Client {
-	dc := &Client{c: c,
-		queue:       make(map[queryTuple]chan Resp),
+	dc := newClient(false)
+	dc.socks = []*udpSocket{dc.addSocket(c)}
+	return dc
+}
+
+// UDPOptions configures sockets of a Client that is created by NewUDP.
+type UDPOptions struct {
+	// Sockets is the number of sockets. Queries are spread across them.
+	// Default is 1.
+	Sockets int
+	// If RotateInterval > 0, a socket will be replaced by a new one (with
+	// a new source port) every RotateInterval. Replaced sockets keep
+	// receiving responses until in-flight queries time out.
+	RotateInterval time.Duration
+	// Batch reads and writes packets in batches (recvmmsg/sendmmsg) on linux.
+	// Outgoing queries are coalesced. It is ignored on other platforms.
+	Batch bool
+}
+
+// NewUDP creates a Client that opens its own UDP sockets.
+func NewUDP(opts UDPOptions) (*Client, error) {
+	n := max(opts.Sockets, 1)
+	dc := newClient(opts.Batch)
+	for i := 0; i < n; i++ {
+		c, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			dc.Close()
+			return nil, fmt.Errorf("failed to open socket, %w", err)
+		}
+		dc.sm.Lock()
+		dc.socks = append(dc.socks, dc.addSocket(c))
+		dc.sm.Unlock()
+	}
+	if opts.RotateInterval > 0 {
+		go dc.rotateLoop(opts.RotateInterval)
+	}
+	return dc, nil
+}
+
+func newClient(batch bool) *Client {
+	return &Client{
+		batch:       batch,
+		cookies:     newCookieJar(),
+		queue:       make(map[queryTuple]pendingQuery),
 		closeNotify: make(chan struct{}),
 	}
-	go dc.readLoop()
-	return dc
+}
+
+// addSocket starts the read loop (and write loop for batched I/O) of uc.
+func (c *Client) addSocket(uc *net.UDPConn) *udpSocket {
+	s := &udpSocket{c: uc, closed: make(chan struct{})}
+	if c.batch {
+		s.bc = newBatchConn(uc)
+	}
+	if s.bc != nil {
+		s.sendQ = make(chan *outPacket)
+		go c.readLoopBatch(s)
+		go c.writeLoop(s)
+	} else {
+		go c.readLoop(s)
+	}
+	return s
+}
+
+// pickSocket returns sockets in round-robin order.
+func (c *Client) pickSocket() *udpSocket {
+	c.sm.RLock()
+	defer c.sm.RUnlock()
+	return c.socks[c.nextSock.Add(1)%uint32(len(c.socks))]
+}
+
+func (c *Client) rotateLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-t.C:
+		case <-c.closeNotify:
+			return
+		}
+		c.rotate(i)
+	}
+}
+
+// rotate replaces the i-th (mod the number of sockets) socket with a new one.
+// The old socket is closed after the query timeout.
+func (c *Client) rotate(i int) {
+	uc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return // Keep the old socket.
+	}
+	c.sm.Lock()
+	select {
+	case <-c.closeNotify:
+		c.sm.Unlock()
+		uc.Close()
+		return
+	default:
+	}
+	idx := i % len(c.socks)
+	old := c.socks[idx]
+	c.socks[idx] = c.addSocket(uc)
+	c.sm.Unlock()
+
+	old.retired.Store(true)
+	time.AfterFunc(orDefault(c.Timeout, defaultTimeout), func() { old.c.Close() })
 }
 
 // Query sends a query to the server through UDP.
@@ -61,35 +212,75 @@ func (c *Client) Query(ctx context.Context, q *dns.Msg, addr netip.AddrPort) (*d
 		return nil, ErrInvalidQuestion
 	}
 
-	resChan := make(chan Resp)
 	question := q.Question[0]
-	if ok := c.Listen(q.Id, question, resChan); !ok {
+	qname := question.Name
+	if c.CaseRandomization {
+		question.Name = randomizeCase(qname)
+		qCopy := *q // shallow copy, only the question is changed.
+		qCopy.Question = []dns.Question{question}
+		q = &qCopy
+	}
+
+	resChan := make(chan Resp, 1)
+	if ok := c.Listen(q.Id, question, addr, resChan); !ok {
 		return nil, ErrQueryCollision
 	}
 	defer c.StopListen(q.Id, question)
 
-	qb, bp, err := PackMsg(q)
-	if err != nil {
-		return nil, fmt.Errorf("failed to pack query, %w", err)
+	var qb []byte
+	var bp *[]byte
+	pack := func() error {
+		if bp != nil {
+			ReleaseMsgBufPointer(bp)
+		}
+		m := q
+		if c.Cookies {
+			m = c.cookies.withCookie(q, addr.Addr().Unmap())
+		}
+		var err error
+		qb, bp, err = PackMsg(m)
+		if err != nil {
+			return fmt.Errorf("failed to pack query, %w", err)
+		}
+		return nil
 	}
-	defer ReleaseMsgBufPointer(bp)
+	if err := pack(); err != nil {
+		return nil, err
+	}
+	defer func() { ReleaseMsgBufPointer(bp) }()
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, defaultTimeout))
 	defer cancel()
 
-	retryTicker := time.NewTicker(time.Second)
-	defer retryTicker.Stop()
+	interval := orDefault(c.RetransmitInterval, defaultRetransmitInterval)
+	retransmitTimer := time.NewTimer(interval)
+	defer retransmitTimer.Stop()
+	cookieRetried := false
 
 send:
-	_, err = c.c.WriteToUDPAddrPort(qb, addr)
-	if err != nil {
+	if _, err := c.WriteTo(qb, addr); err != nil {
 		return nil, fmt.Errorf("failed to send query, %w", err)
 	}
 
 	select {
-	case <-retryTicker.C:
+	case <-retransmitTimer.C:
+		interval = c.nextRetransmitInterval(interval)
+		retransmitTimer.Reset(interval)
 		goto send
 	case resp := <-resChan:
+		if c.Cookies {
+			// Cookies were checked by handlePacket.
+			if resp.Msg.Rcode == dns.RcodeBadCookie && !cookieRetried {
+				cookieRetried = true
+				if err := pack(); err != nil {
+					return nil, err
+				}
+				goto send
+			}
+		}
+		if c.CaseRandomization {
+			restoreCase(resp.Msg, qname)
+		}
 		return resp.Msg, nil
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -98,19 +289,30 @@ send:
 	}
 }
 
-// Listen register resChan to the queue. If there is a collision, Listen returns false.
+// nextRetransmitInterval returns the interval after a retransmit
+// that waited for d.
+func (c *Client) nextRetransmitInterval(d time.Duration) time.Duration {
+	if c.RetransmitBackoff > 1 {
+		return time.Duration(float64(d) * c.RetransmitBackoff)
+	}
+	return d
+}
+
+// Listen register resChan to the queue. Only responses from addr will be sent
+// to resChan. The question of responses must be identical to q, including
+// the case of the name. If there is a collision, Listen returns false.
 // Note: c.NextQid() can return a increasing id that can make the collision nearly impossible.
-func (c *Client) Listen(id uint16, q dns.Question, resChan chan Resp) bool {
+func (c *Client) Listen(id uint16, q dns.Question, addr netip.AddrPort, resChan chan Resp) bool {
 	qt := queryTuple{
 		id:       id,
 		question: q,
 	}
 	c.m.Lock()
-	if cc, collision := c.queue[qt]; collision && cc != resChan {
+	if pq, collision := c.queue[qt]; collision && pq.c != resChan {
 		c.m.Unlock()
 		return false
 	}
-	c.queue[qt] = resChan
+	c.queue[qt] = pendingQuery{c: resChan, addr: unmapAddrPort(addr)}
 	c.m.Unlock()
 	return true
 }
@@ -127,9 +329,14 @@ func (c *Client) StopListen(id uint16, q dns.Question) {
 	c.m.Unlock()
 }
 
-// WriteTo calls inner UDP connection's WriteToUDPAddrPort method.
+// WriteTo writes b to addr through one of the inner UDP connections.
+// With batched I/O, it may be written with other packets in one syscall.
 func (c *Client) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
-	return c.c.WriteToUDPAddrPort(b, addr)
+	s := c.pickSocket()
+	if s.sendQ != nil {
+		return s.enqueue(b, addr)
+	}
+	return s.c.WriteToUDPAddrPort(b, addr)
 }
 
 // NextQid returns a increasing uint16 counter. This is a helper func for dns query id
@@ -138,37 +345,63 @@ func (c *Client) NextQid() uint16 {
 	return uint16(atomic.AddUint32(&c.nextQid, 1))
 }
 
-func (c *Client) readLoop() {
-	b := make([]byte, 4096)
+func (c *Client) readLoop(s *udpSocket) {
+	defer close(s.closed)
+	b := make([]byte, udpReadBufSize)
 	for {
-		n, from, err := c.c.ReadFromUDPAddrPort(b)
+		n, from, err := s.c.ReadFromUDPAddrPort(b)
 		if err != nil {
-			c.closeWithErr(err)
+			if !s.retired.Load() {
+				c.closeWithErr(err)
+			}
 			return
 		}
+		c.handlePacket(b[:n], from)
+	}
+}
 
-		r := new(dns.Msg)
-		if err := r.Unpack(b[:n]); err != nil {
-			continue // Ignore invalid udp msg.
-		}
-		if !r.Response || len(r.Question) != 1 {
-			continue
-		}
+// handlePacket delivers a received packet to its listener.
+func (c *Client) handlePacket(b []byte, from netip.AddrPort) {
+	r := new(dns.Msg)
+	if err := r.Unpack(b); err != nil {
+		c.malformed.Add(1) // Ignore invalid udp msg.
+		return
+	}
+	if !r.Response || len(r.Question) != 1 {
+		c.malformed.Add(1)
+		return
+	}
 
-		qt := queryTuple{
-			id:       r.Id,
-			question: r.Question[0],
-		}
-		c.m.Lock()
-		resChan := c.queue[qt]
-		c.m.Unlock()
-		if resChan != nil {
-			select {
-			case resChan <- Resp{From: from, Msg: r}: // resChan should have buffer.
-			default:
-			}
+	qt := queryTuple{
+		id:       r.Id,
+		question: r.Question[0],
+	}
+	c.m.Lock()
+	pq, ok := c.queue[qt]
+	c.m.Unlock()
+	if !ok {
+		c.unmatched.Add(1)
+		return
+	}
+	if unmapAddrPort(from) != pq.addr {
+		c.badSource.Add(1)
+		return
+	}
+	// Check cookies before delivering, a forged response must not take
+	// the place of the real one.
+	if c.Cookies {
+		switch c.cookies.learn(r, pq.addr.Addr()) {
+		case cookieBad:
+			c.badCookie.Add(1)
+			return
+		case cookieMissing:
+			c.noCookie.Add(1)
 		}
 	}
+	select {
+	case pq.c <- Resp{From: from, Msg: r}: // resChan should have buffer.
+	default:
+	}
 }
 
 func (c *Client) closeWithErr(err error) {
@@ -176,7 +409,11 @@ func (c *Client) closeWithErr(err error) {
 		err = ErrClientClosed
 	}
 	c.closeOnce.Do(func() {
-		_ = c.c.Close()
+		c.sm.Lock()
+		for _, s := range c.socks {
+			_ = s.c.Close()
+		}
+		c.sm.Unlock()
 		c.closeErr = err
 		close(c.closeNotify)
 	})
@@ -186,3 +423,10 @@ func (c *Client) Close() error {
 	c.closeWithErr(nil)
 	return nil
 }
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
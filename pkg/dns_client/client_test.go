@@ -0,0 +1,413 @@
+package dnsClient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dropHandler drops the first n queries of each id and replies the rest.
+type dropHandler struct {
+	m        sync.Mutex
+	n        int
+	received map[uint16]int
+}
+
+func (h *dropHandler) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	h.m.Lock()
+	if h.received == nil {
+		h.received = make(map[uint16]int)
+	}
+	h.received[q.Id]++
+	drop := h.received[q.Id] <= h.n
+	h.m.Unlock()
+	if !drop {
+		echoHandler(w, q)
+	}
+}
+
+func (h *dropHandler) count(id uint16) int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.received[id]
+}
+
+func Test_Client_retransmit(t *testing.T) {
+	r := require.New(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	r.NoError(err)
+	h := &dropHandler{n: 3}
+	s := &dns.Server{PacketConn: pc, Handler: h}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	addr := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	uc, err := net.ListenUDP("udp", nil)
+	r.NoError(err)
+	c := New(uc)
+	defer c.Close()
+	c.RetransmitInterval = time.Millisecond * 10
+
+	// The query is answered after the server dropped it 3 times.
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Id = 1
+	resp, err := c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Len(resp.Answer, 1)
+	r.GreaterOrEqual(h.count(1), 4)
+
+	// All queries are dropped.
+	h.m.Lock()
+	h.n = 1 << 30
+	h.m.Unlock()
+	c.Timeout = time.Millisecond * 50
+	q.Id = 2
+	_, err = c.Query(context.Background(), q, addr)
+	r.ErrorIs(err, context.DeadlineExceeded)
+	r.GreaterOrEqual(h.count(2), 1)
+}
+
+func Test_Client_nextRetransmitInterval(t *testing.T) {
+	r := require.New(t)
+
+	c := new(Client)
+	r.Equal(time.Second, c.nextRetransmitInterval(time.Second))
+	c.RetransmitBackoff = 2
+	d := time.Millisecond * 20
+	for _, want := range []time.Duration{40, 80, 160} {
+		d = c.nextRetransmitInterval(d)
+		r.Equal(want*time.Millisecond, d)
+	}
+}
+
+// startEchoResponder starts a UDP responder that sends queries back with
+// the QR bit set. It is cheaper than a dns.Server. Source addresses of
+// received packets are passed to onRecv if it is not nil.
+func startEchoResponder(tb testing.TB, onRecv func(from netip.AddrPort)) netip.AddrPort {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(tb, err)
+	tb.Cleanup(func() { c.Close() })
+	for i := 0; i < 4; i++ {
+		go func() {
+			b := make([]byte, 512)
+			for {
+				n, from, err := c.ReadFromUDPAddrPort(b)
+				if err != nil {
+					return
+				}
+				if n < 12 {
+					continue
+				}
+				if onRecv != nil {
+					onRecv(from)
+				}
+				b[2] |= 0x80 // QR
+				c.WriteToUDPAddrPort(b[:n], from)
+			}
+		}()
+	}
+	return c.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func Test_Client_sockets(t *testing.T) {
+	r := require.New(t)
+
+	var m sync.Mutex
+	var ports []uint16
+	addr := startEchoResponder(t, func(from netip.AddrPort) {
+		m.Lock()
+		ports = append(ports, from.Port())
+		m.Unlock()
+	})
+	// sentPorts returns source ports of queries since the last call.
+	sentPorts := func() map[uint16]struct{} {
+		m.Lock()
+		defer m.Unlock()
+		set := make(map[uint16]struct{})
+		for _, p := range ports {
+			set[p] = struct{}{}
+		}
+		ports = nil
+		return set
+	}
+
+	c, err := NewUDP(UDPOptions{Sockets: 4})
+	r.NoError(err)
+	defer c.Close()
+	query := func(n int) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		for i := 0; i < n; i++ {
+			q.Id = c.NextQid()
+			_, err := c.Query(context.Background(), q, addr)
+			r.NoError(err)
+		}
+	}
+
+	// Queries are sent through sockets in turn. The responder has received
+	// a query before it answers, so ports are complete after Query returns.
+	query(8)
+	before := sentPorts()
+	r.Len(before, 4)
+
+	// A rotated socket is replaced by one with a new port.
+	c.rotate(0)
+	query(8)
+	after := sentPorts()
+	r.Len(after, 4)
+	for p := range after {
+		before[p] = struct{}{}
+	}
+	r.Len(before, 5)
+
+	// The counter is larger than the max int32 (int on 32-bit platforms).
+	c.nextSock.Store(1<<31 - 1)
+	query(8)
+	r.Len(sentPorts(), 4)
+}
+
+func Test_Client_batch(t *testing.T) {
+	r := require.New(t)
+	addr := startEchoResponder(t, nil)
+	c, err := NewUDP(UDPOptions{Sockets: 2, Batch: true})
+	r.NoError(err)
+	defer c.Close()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 256; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			q.Id = c.NextQid()
+			resp, err := c.Query(context.Background(), q, addr)
+			if assert.NoError(t, err) {
+				assert.Equal(t, q.Id, resp.Id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Queries after close.
+	c.Close()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Query(context.Background(), q, addr)
+	r.Error(err)
+}
+
+func Test_Client_batchLargeResponse(t *testing.T) {
+	r := require.New(t)
+
+	// Responses are larger than 4096 bytes.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	r.NoError(err)
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		for i := 0; i < 40; i++ {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{strings.Repeat("a", 250)},
+			})
+		}
+		w.WriteMsg(resp)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	addr := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	c, err := NewUDP(UDPOptions{Batch: true})
+	r.NoError(err)
+	defer c.Close()
+	c.Timeout = time.Second * 2
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	q.Id = c.NextQid()
+	resp, err := c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Len(resp.Answer, 40)
+	r.Zero(c.Stats().Malformed)
+}
+
+// partialBatchConn writes the first n packets of every batch and fails the rest.
+type partialBatchConn struct {
+	batchConn
+	n int
+}
+
+func (bc *partialBatchConn) writeBatch(ps []*outPacket) (int, error) {
+	if len(ps) <= bc.n {
+		return len(ps), nil
+	}
+	return bc.n, errors.New("partial write")
+}
+
+func Test_flushBatch(t *testing.T) {
+	r := require.New(t)
+
+	var ps []*outPacket
+	for i := 0; i < 3; i++ {
+		ps = append(ps, &outPacket{done: make(chan error, 1)})
+	}
+	flushBatch(&partialBatchConn{n: 1}, ps)
+	r.NoError(<-ps[0].done)
+	r.Error(<-ps[1].done)
+	r.Error(<-ps[2].done)
+}
+
+func benchmarkClient(b *testing.B, sockets int, batch bool) {
+	addr := startEchoResponder(b, nil)
+	c, err := NewUDP(UDPOptions{Sockets: sockets, Batch: batch})
+	require.NoError(b, err)
+	defer c.Close()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		for pb.Next() {
+			q.Id = c.NextQid()
+			if _, err := c.Query(context.Background(), q, addr); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+func Benchmark_Client_1Socket(b *testing.B)        { benchmarkClient(b, 1, false) }
+func Benchmark_Client_4Sockets(b *testing.B)       { benchmarkClient(b, 4, false) }
+func Benchmark_Client_1Socket_Batch(b *testing.B)  { benchmarkClient(b, 1, true) }
+func Benchmark_Client_4Sockets_Batch(b *testing.B) { benchmarkClient(b, 4, true) }
+
+func Test_Client_validation(t *testing.T) {
+	r := require.New(t)
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	r.NoError(err)
+	c := New(uc)
+	defer c.Close()
+	c.Timeout = time.Millisecond * 200
+
+	// The server sends a forged response from another address before its
+	// real response.
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	r.NoError(err)
+	defer attacker.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	r.NoError(err)
+	var lowerCase atomic.Bool
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		forged := new(dns.Msg)
+		forged.SetReply(q)
+		b, _ := forged.Pack()
+		attacker.WriteToUDPAddrPort(b, uc.LocalAddr().(*net.UDPAddr).AddrPort())
+		time.Sleep(time.Millisecond * 20)
+		if lowerCase.Load() {
+			q.Question[0].Name = strings.ToLower(q.Question[0].Name)
+		}
+		echoHandler(w, q)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	addr := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Id = 1
+	resp, err := c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Len(resp.Answer, 1)
+	r.Equal(uint64(1), c.Stats().BadSource)
+
+	// Responses must echo the randomized qname. Names are restored.
+	c.CaseRandomization = true
+	q.SetQuestion("a-long-name-that-has-many-letters.example.com.", dns.TypeA)
+	q.Id = 2
+	resp, err = c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Equal(q.Question[0].Name, resp.Question[0].Name)
+	r.Equal(q.Question[0].Name, resp.Answer[0].Header().Name)
+
+	lowerCase.Store(true)
+	q.Id = 3
+	_, err = c.Query(context.Background(), q, addr)
+	r.ErrorIs(err, context.DeadlineExceeded)
+	r.NotZero(c.Stats().Unmatched)
+}
+
+func Test_Client_caseRandomizationCompression(t *testing.T) {
+	r := require.New(t)
+
+	// The server builds names from the randomized question, like a server
+	// that compresses names against it.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	r.NoError(err)
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		name := q.Question[0].Name // www.example.com. randomized
+		parent := name[len("www."):]
+		hdr := func(name string, t uint16) dns.RR_Header {
+			return dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET, Ttl: 300}
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Compress = true
+		resp.Answer = append(resp.Answer, &dns.CNAME{Hdr: hdr(name, dns.TypeCNAME), Target: "cdn." + parent})
+		resp.Ns = append(resp.Ns, &dns.NS{Hdr: hdr(parent, dns.TypeNS), Ns: "ns1." + parent})
+		resp.Extra = append(resp.Extra, &dns.A{Hdr: hdr("ns1."+parent, dns.TypeA), A: net.IPv4(192, 0, 2, 1)})
+		w.WriteMsg(resp)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	addr := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	uc, err := net.ListenUDP("udp", nil)
+	r.NoError(err)
+	c := New(uc)
+	defer c.Close()
+	c.CaseRandomization = true
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	q.Id = 1
+	resp, err := c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Equal("www.example.com.", resp.Question[0].Name)
+	r.Equal("www.example.com.", resp.Answer[0].Header().Name)
+	r.Equal("cdn.example.com.", resp.Answer[0].(*dns.CNAME).Target)
+	r.Equal("example.com.", resp.Ns[0].Header().Name)
+	r.Equal("ns1.example.com.", resp.Ns[0].(*dns.NS).Ns)
+	r.Equal("ns1.example.com.", resp.Extra[0].Header().Name)
+}
+
+func Test_restoreSuffixCase(t *testing.T) {
+	tests := []struct {
+		s, name, want string
+	}{
+		{"WwW.eXaMpLe.CoM.", "www.example.com.", "www.example.com."},
+		{"nS1.eXaMpLe.CoM.", "www.example.com.", "nS1.example.com."},
+		{"Ns.OtHeR.NeT.", "www.example.com.", "Ns.OtHeR.NeT."},
+		{"bExAmPlE.CoM.", "www.example.com.", "bExAmPlE.com."}, // Only whole labels.
+		{".", "example.com.", "."},
+		{"ExAmPlE.cOm.", ".", "ExAmPlE.cOm."},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, restoreSuffixCase(tt.s, tt.name), tt.s)
+	}
+}
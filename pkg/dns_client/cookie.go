@@ -0,0 +1,125 @@
+package dnsClient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	clientCookieLen  = 8 // bytes
+	maxCookieServers = 1 << 16
+)
+
+// cookieJar keeps DNS cookies (RFC 7873) of servers.
+type cookieJar struct {
+	m       sync.Mutex
+	servers map[netip.Addr]*serverCookies
+}
+
+type serverCookies struct {
+	client string // hex
+	server string // hex, learned from responses. Can be empty.
+}
+
+func newCookieJar() *cookieJar {
+	return &cookieJar{servers: make(map[netip.Addr]*serverCookies)}
+}
+
+// get returns cookies of server. A new client cookie will be generated
+// for a new server.
+func (j *cookieJar) get(server netip.Addr) (client, srv string) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	sc := j.servers[server]
+	if sc == nil {
+		if len(j.servers) >= maxCookieServers {
+			for k := range j.servers { // Remove a random one.
+				delete(j.servers, k)
+				break
+			}
+		}
+		b := make([]byte, clientCookieLen)
+		rand.Read(b)
+		sc = &serverCookies{client: hex.EncodeToString(b)}
+		j.servers[server] = sc
+	}
+	return sc.client, sc.server
+}
+
+// withCookie returns a copy of q that has the COOKIE option of server.
+// If q has no OPT record, q will be returned.
+func (j *cookieJar) withCookie(q *dns.Msg, server netip.Addr) *dns.Msg {
+	opt := q.IsEdns0()
+	if opt == nil {
+		return q
+	}
+	client, srv := j.get(server)
+
+	optCopy := *opt
+	optCopy.Option = make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			optCopy.Option = append(optCopy.Option, o)
+		}
+	}
+	optCopy.Option = append(optCopy.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + srv})
+
+	qCopy := *q // shallow copy, only the OPT record is changed.
+	qCopy.Extra = make([]dns.RR, 0, len(q.Extra))
+	for _, rr := range q.Extra {
+		if rr == opt {
+			rr = &optCopy
+		}
+		qCopy.Extra = append(qCopy.Extra, rr)
+	}
+	return &qCopy
+}
+
+// cookieResult is the result of cookieJar.learn.
+type cookieResult int
+
+const (
+	cookieOk cookieResult = iota
+	// The client cookie is not ours, the response may be forged.
+	cookieBad
+	// No cookie, but the server has sent one before. The response is
+	// still accepted, because servers behind a load balancer may not
+	// all support cookies.
+	cookieMissing
+)
+
+// learn stores the server cookie in r and checks its client cookie.
+func (j *cookieJar) learn(r *dns.Msg, server netip.Addr) cookieResult {
+	var c *dns.EDNS0_COOKIE
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if v, ok := o.(*dns.EDNS0_COOKIE); ok {
+				c = v
+				break
+			}
+		}
+	}
+
+	j.m.Lock()
+	defer j.m.Unlock()
+	sc := j.servers[server]
+	if sc == nil {
+		return cookieOk // Removed from the jar, can't verify.
+	}
+	if c == nil {
+		if len(sc.server) > 0 {
+			return cookieMissing
+		}
+		return cookieOk
+	}
+	if len(c.Cookie) < len(sc.client) || !strings.EqualFold(c.Cookie[:len(sc.client)], sc.client) {
+		return cookieBad
+	}
+	sc.server = strings.ToLower(c.Cookie[len(sc.client):])
+	return cookieOk
+}
@@ -0,0 +1,100 @@
+package dnsClient
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Client_cookies(t *testing.T) {
+	r := require.New(t)
+
+	const serverCookie = "0102030405060708"
+	var queries, forge, noCookie atomic.Int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	r.NoError(err)
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		queries.Add(1)
+		var cookie string
+		if opt := q.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+					cookie = c.Cookie
+				}
+			}
+		}
+		if len(cookie) < 16 {
+			w.WriteMsg(new(dns.Msg).SetRcode(q, dns.RcodeFormatError))
+			return
+		}
+		reply := func(clientCookie string) {
+			resp := new(dns.Msg)
+			resp.SetReply(q)
+			resp.SetEdns0(1200, false)
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: clientCookie + serverCookie})
+			if cookie[16:] != serverCookie {
+				resp.Rcode = dns.RcodeBadCookie
+			}
+			w.WriteMsg(resp)
+		}
+		if noCookie.Load() > 0 {
+			w.WriteMsg(new(dns.Msg).SetReply(q))
+			return
+		}
+		if forge.Load() > 0 {
+			reply("ffffffffffffffff")
+		}
+		reply(cookie[:16])
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	addr := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	uc, err := net.ListenUDP("udp", nil)
+	r.NoError(err)
+	c := New(uc)
+	defer c.Close()
+	c.Cookies = true
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1200, false)
+
+	// The first query learns the server cookie by BADCOOKIE.
+	q.Id = 1
+	resp, err := c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Equal(dns.RcodeSuccess, resp.Rcode)
+	r.EqualValues(2, queries.Load())
+
+	q.Id = 2
+	resp, err = c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Equal(dns.RcodeSuccess, resp.Rcode)
+	r.EqualValues(3, queries.Load())
+
+	// Responses with other client cookies are dropped. The real response
+	// that follows is accepted without a retransmit.
+	forge.Store(1)
+	q.Id = 3
+	resp, err = c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Equal(dns.RcodeSuccess, resp.Rcode)
+	r.EqualValues(1, c.Stats().BadCookie)
+	r.EqualValues(4, queries.Load())
+
+	// Responses without cookies are accepted and counted.
+	noCookie.Store(1)
+	q.Id = 4
+	resp, err = c.Query(context.Background(), q, addr)
+	r.NoError(err)
+	r.Equal(dns.RcodeSuccess, resp.Rcode)
+	r.EqualValues(1, c.Stats().NoCookie)
+
+	// q is not modified.
+	r.Empty(q.IsEdns0().Option)
+}
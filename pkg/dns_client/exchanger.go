@@ -0,0 +1,109 @@
+package dnsClient
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Exchanger sends a query to its server and returns the response.
+// q must have and only have one question. Implementations must not
+// modify q.
+type Exchanger interface {
+	Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+}
+
+// Transport creates Exchangers that send queries to addr.
+type Transport interface {
+	Exchanger(addr netip.AddrPort) Exchanger
+}
+
+// Exchanger returns an Exchanger that sends queries to addr through UDP.
+// Query ids are assigned by c.NextQid().
+func (c *Client) Exchanger(addr netip.AddrPort) Exchanger {
+	return &udpExchanger{c: c, addr: addr}
+}
+
+type udpExchanger struct {
+	c    *Client
+	addr netip.AddrPort
+}
+
+func (e *udpExchanger) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	qCopy := *q // shallow copy, only the id is changed.
+	qCopy.Id = e.c.NextQid()
+	resp, err := e.c.Query(ctx, &qCopy, e.addr)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = q.Id
+	return resp, nil
+}
+
+// Exchanger returns an Exchanger that sends queries to addr through TCP.
+func (c *TCPClient) Exchanger(addr netip.AddrPort) Exchanger {
+	return &tcpExchanger{c: c, addr: addr}
+}
+
+type tcpExchanger struct {
+	c    *TCPClient
+	addr netip.AddrPort
+}
+
+func (e *tcpExchanger) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return e.c.Query(ctx, q, e.addr)
+}
+
+// Fake is an in-memory Exchanger and Transport for tests. All queries
+// are answered by Handler. As an Exchanger, addr is always zero.
+type Fake struct {
+	Handler func(q *dns.Msg, addr netip.AddrPort) (*dns.Msg, error)
+
+	m       sync.Mutex
+	queries []FakeQuery
+}
+
+// FakeQuery is a query received by Fake.
+type FakeQuery struct {
+	Addr     netip.AddrPort
+	Question dns.Question
+}
+
+func (f *Fake) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return f.exchange(ctx, q, netip.AddrPort{})
+}
+
+func (f *Fake) Exchanger(addr netip.AddrPort) Exchanger {
+	return &fakeExchanger{f: f, addr: addr}
+}
+
+// Queries returns all queries that f received.
+func (f *Fake) Queries() []FakeQuery {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]FakeQuery(nil), f.queries...)
+}
+
+func (f *Fake) exchange(ctx context.Context, q *dns.Msg, addr netip.AddrPort) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, ErrInvalidQuestion
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.m.Lock()
+	f.queries = append(f.queries, FakeQuery{Addr: addr, Question: q.Question[0]})
+	f.m.Unlock()
+	return f.Handler(q.Copy(), addr)
+}
+
+type fakeExchanger struct {
+	f    *Fake
+	addr netip.AddrPort
+}
+
+func (e *fakeExchanger) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return e.f.exchange(ctx, q, e.addr)
+}
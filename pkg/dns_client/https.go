@@ -0,0 +1,122 @@
+package dnsClient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMediaType   = "application/dns-message"
+	dohMaxRespSize = 65535
+)
+
+// NewHTTPTransport creates a http transport that can be shared by
+// HTTPSClients. It prefers HTTP/2. tlsConfig can be nil. It is cloned
+// because net/http modifies the config (e.g. NextProtos).
+func NewHTTPTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig.Clone(),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     time.Second * 90,
+		TLSHandshakeTimeout: time.Second * 5,
+	}
+}
+
+// HTTPSClient sends queries to a DNS-over-HTTPS (RFC 8484) server.
+type HTTPSClient struct {
+	// Timeout is the maximum time of a query. Default is 5s.
+	Timeout time.Duration
+
+	url    *url.URL
+	useGet bool
+	c      *http.Client
+}
+
+// NewHTTPS creates a HTTPSClient that sends queries to rawURL
+// (e.g. "https://dns.google/dns-query") through transport.
+// If useGet is true, queries are sent with GET, otherwise POST.
+func NewHTTPS(rawURL string, transport http.RoundTripper, useGet bool) (*HTTPSClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPSClient{
+		url:    u,
+		useGet: useGet,
+		c:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// Exchange sends q to the server.
+// It waits until the response received or ctx was done.
+// q must have and only have one question.
+func (c *HTTPSClient) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, ErrInvalidQuestion
+	}
+
+	// RFC 8484 4.1: use id 0 to make responses more cache friendly.
+	qCopy := *q
+	qCopy.Id = 0
+	qb, bp, err := PackMsg(&qCopy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query, %w", err)
+	}
+	defer ReleaseMsgBufPointer(bp)
+
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, defaultTimeout))
+	defer cancel()
+
+	var req *http.Request
+	if c.useGet {
+		u := *c.url
+		query := u.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(qb))
+		u.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.url.String(), bytes.NewReader(qb))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request, %w", err)
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	httpResp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad http status %d", httpResp.StatusCode)
+	}
+	if mt, _, _ := mime.ParseMediaType(httpResp.Header.Get("Content-Type")); mt != dohMediaType {
+		return nil, fmt.Errorf("bad content type %q", httpResp.Header.Get("Content-Type"))
+	}
+
+	b, err := io.ReadAll(io.LimitReader(httpResp.Body, dohMaxRespSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body, %w", err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(b); err != nil {
+		return nil, fmt.Errorf("invalid response, %w", err)
+	}
+	resp.Id = q.Id
+	return resp, nil
+}
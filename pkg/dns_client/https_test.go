@@ -0,0 +1,80 @@
+package dnsClient
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HTTPSClient(t *testing.T) {
+	r := require.New(t)
+
+	var lastMethod, lastProto, lastX string
+	contentType := dohMediaType
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lastMethod, lastProto, lastX = req.Method, req.Proto, req.URL.Query().Get("x")
+		var b []byte
+		var err error
+		if req.Method == http.MethodGet {
+			b, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		} else {
+			b, err = io.ReadAll(req.Body)
+		}
+		q := new(dns.Msg)
+		if err != nil || q.Unpack(b) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		rb, _ := resp.Pack()
+		w.Header().Set("Content-Type", contentType)
+		w.Write(rb)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The tls config is shared with DoT clients and must not be modified.
+	tlsConfig := &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	tr := NewHTTPTransport(tlsConfig)
+	defer func() { r.Empty(tlsConfig.NextProtos) }()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Id = 1234
+
+	for _, useGet := range []bool{false, true} {
+		c, err := NewHTTPS(srv.URL+"/dns-query?x=1", tr, useGet)
+		r.NoError(err)
+		resp, err := c.Exchange(context.Background(), q)
+		r.NoError(err)
+		r.Equal(q.Id, resp.Id)
+		r.Equal("HTTP/2.0", lastProto)
+		r.Equal("1", lastX)
+		if useGet {
+			r.Equal(http.MethodGet, lastMethod)
+		} else {
+			r.Equal(http.MethodPost, lastMethod)
+		}
+	}
+
+	// Responses that are not dns messages.
+	contentType = "text/html"
+	c, err := NewHTTPS(srv.URL+"/dns-query", tr, false)
+	r.NoError(err)
+	_, err = c.Exchange(context.Background(), q)
+	r.ErrorContains(err, "content type")
+
+	c, err = NewHTTPS(srv.URL+"/dns-query", http.DefaultTransport, false)
+	r.NoError(err)
+	_, err = c.Exchange(context.Background(), q)
+	r.Error(err) // Unknown certificate.
+}
@@ -0,0 +1,298 @@
+package dnsClient
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrTooManyPending = errors.New("too many pending queries")
+)
+
+const (
+	defaultIdleTimeout = time.Second * 10
+	writeTimeout       = time.Second * 5
+	dialTimeout        = time.Second * 5
+)
+
+// streamConn is a pipelined connection that sends dns messages with
+// a two-byte length prefix (TCP, TLS). Queries are sent with connection
+// local ids, so queries with the same id can be sent concurrently.
+type streamConn struct {
+	c           net.Conn
+	idleTimeout time.Duration
+
+	wm sync.Mutex // Protects writes of c.
+
+	m       sync.Mutex
+	queue   map[uint16]chan *dns.Msg
+	nextQid uint16
+	// latestDeadline is the latest deadline of queries since queue
+	// was last empty. Zero if there is no deadline.
+	latestDeadline time.Time
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	closeErr    error
+}
+
+func newStreamConn(c net.Conn, idleTimeout time.Duration) *streamConn {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	sc := &streamConn{
+		c:           c,
+		idleTimeout: idleTimeout,
+		queue:       make(map[uint16]chan *dns.Msg),
+		closeNotify: make(chan struct{}),
+	}
+	go sc.readLoop()
+	return sc
+}
+
+// exchange sends q and waits for its response.
+func (sc *streamConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	resChan := make(chan *dns.Msg, 1)
+	deadline, _ := ctx.Deadline()
+	id, ok := sc.register(resChan, deadline)
+	if !ok {
+		return nil, ErrTooManyPending
+	}
+	defer sc.unregister(id)
+
+	qCopy := *q // shallow copy, only the id is changed.
+	qCopy.Id = id
+	qb, bp, err := PackMsg(&qCopy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query, %w", err)
+	}
+	err = sc.write(qb)
+	ReleaseMsgBufPointer(bp)
+	if err != nil {
+		sc.closeWithErr(err)
+		return nil, fmt.Errorf("failed to send query, %w", err)
+	}
+
+	select {
+	case resp := <-resChan:
+		resp.Id = q.Id
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-sc.closeNotify:
+		return nil, sc.closeErr
+	}
+}
+
+func (sc *streamConn) write(qb []byte) error {
+	b := make([]byte, 2+len(qb))
+	binary.BigEndian.PutUint16(b, uint16(len(qb)))
+	copy(b[2:], qb)
+
+	sc.wm.Lock()
+	defer sc.wm.Unlock()
+	sc.c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := sc.c.Write(b)
+	return err
+}
+
+func (sc *streamConn) register(resChan chan *dns.Msg, deadline time.Time) (uint16, bool) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	if len(sc.queue) > 0xffff {
+		return 0, false
+	}
+	if deadline.After(sc.latestDeadline) {
+		sc.latestDeadline = deadline
+	}
+	for {
+		sc.nextQid++
+		if _, dup := sc.queue[sc.nextQid]; !dup {
+			sc.queue[sc.nextQid] = resChan
+			break
+		}
+	}
+	// The read loop may be blocked with an earlier deadline.
+	sc.setReadDeadlineLocked()
+	return sc.nextQid, true
+}
+
+func (sc *streamConn) unregister(id uint16) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	delete(sc.queue, id)
+	if len(sc.queue) == 0 {
+		sc.latestDeadline = time.Time{}
+		sc.setReadDeadlineLocked()
+	}
+}
+
+// setReadDeadlineLocked sets the read deadline of c. Idle connections
+// will be closed after idleTimeout. Connections that have pending
+// queries are kept until the latest deadline of them.
+// sc.m must be held.
+func (sc *streamConn) setReadDeadlineLocked() {
+	d := time.Now().Add(sc.idleTimeout)
+	if len(sc.queue) > 0 && sc.latestDeadline.After(d) {
+		d = sc.latestDeadline
+	}
+	sc.c.SetReadDeadline(d)
+}
+
+func (sc *streamConn) readLoop() {
+	hdr := make([]byte, 2)
+	for {
+		sc.m.Lock()
+		sc.setReadDeadlineLocked()
+		sc.m.Unlock()
+		if _, err := io.ReadFull(sc.c, hdr); err != nil {
+			sc.closeWithErr(err)
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(hdr))
+		if _, err := io.ReadFull(sc.c, b); err != nil {
+			sc.closeWithErr(err)
+			return
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(b); err != nil {
+			sc.closeWithErr(fmt.Errorf("invalid msg, %w", err))
+			return
+		}
+
+		sc.m.Lock()
+		resChan := sc.queue[r.Id]
+		sc.m.Unlock()
+		if resChan != nil {
+			select {
+			case resChan <- r:
+			default:
+			}
+		}
+	}
+}
+
+func (sc *streamConn) isClosed() bool {
+	select {
+	case <-sc.closeNotify:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sc *streamConn) closeWithErr(err error) {
+	if err == nil {
+		err = ErrClientClosed
+	}
+	sc.closeOnce.Do(func() {
+		_ = sc.c.Close()
+		sc.closeErr = err
+		close(sc.closeNotify)
+	})
+}
+
+// streamPool holds a reusable streamConn to a server.
+type streamPool struct {
+	dial        func(ctx context.Context) (net.Conn, error)
+	idleTimeout time.Duration
+
+	m       sync.Mutex
+	sc      *streamConn
+	dialing *dialCall // Nil if no dial is ongoing.
+	closed  bool
+}
+
+// dialCall is an ongoing dial of a streamPool.
+type dialCall struct {
+	done chan struct{} // Closed when sc or err is set.
+	sc   *streamConn
+	err  error
+}
+
+// exchange sends q through the pooled connection. A new connection
+// will be dialed if there is no alive one.
+func (p *streamPool) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	sc, reused, err := p.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sc.exchange(ctx, q)
+	if err != nil && reused && ctx.Err() == nil && sc.isClosed() {
+		// The reused connection may be closed by the server. Retry once on a new one.
+		if sc, _, err = p.getConn(ctx); err != nil {
+			return nil, err
+		}
+		return sc.exchange(ctx, q)
+	}
+	return resp, err
+}
+
+func (p *streamPool) getConn(ctx context.Context) (sc *streamConn, reused bool, err error) {
+	p.m.Lock()
+	if p.closed {
+		p.m.Unlock()
+		return nil, false, ErrClientClosed
+	}
+	if p.sc != nil && !p.sc.isClosed() {
+		sc := p.sc
+		p.m.Unlock()
+		return sc, true, nil
+	}
+	// Dial without holding p.m, so callers are not blocked by a slow
+	// server and can give up with their ctx. Concurrent callers share
+	// one dial, which is not bound to any of their ctx.
+	call := p.dialing
+	if call == nil {
+		call = &dialCall{done: make(chan struct{})}
+		p.dialing = call
+		go p.dialConn(call)
+	}
+	p.m.Unlock()
+
+	select {
+	case <-call.done:
+		return call.sc, false, call.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+func (p *streamPool) dialConn(call *dialCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	c, err := p.dial(ctx)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.dialing = nil
+	switch {
+	case err != nil:
+		call.err = fmt.Errorf("failed to dial, %w", err)
+	case p.closed:
+		c.Close()
+		call.err = ErrClientClosed
+	default:
+		p.sc = newStreamConn(c, p.idleTimeout)
+		call.sc = p.sc
+	}
+	close(call.done)
+}
+
+func (p *streamPool) close() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.closed = true
+	if p.sc != nil {
+		p.sc.closeWithErr(nil)
+	}
+}
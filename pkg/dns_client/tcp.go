@@ -0,0 +1,130 @@
+package dnsClient
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultMaxPools = 1024
+
+// TCPClient sends queries through TCP. Connections to the same server
+// are reused, and queries on a connection are pipelined (RFC 7766).
+type TCPClient struct {
+	// IdleTimeout is the time that a connection will be closed if it
+	// has no pending query. Default is 10s.
+	IdleTimeout time.Duration
+	// Timeout is the maximum time of a query. Default is 5s.
+	Timeout time.Duration
+	// MaxPools is the maximum number of servers that have pooled connections.
+	// When exceeded, connections to least recently used servers that have
+	// no ongoing query will be closed. Default is 1024.
+	MaxPools int
+
+	m      sync.Mutex
+	pools  map[netip.AddrPort]*list.Element // *tcpPool in lru
+	lru    *list.List                       // *tcpPool, most recently used first.
+	closed bool
+}
+
+// tcpPool is the streamPool of a server.
+type tcpPool struct {
+	addr  netip.AddrPort
+	p     *streamPool
+	users int // Ongoing queries. Protected by TCPClient.m.
+}
+
+func NewTCP() *TCPClient {
+	return &TCPClient{
+		pools: make(map[netip.AddrPort]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// Query sends q to the server through TCP.
+// It waits until the response received or ctx was done.
+// q must have and only have one question.
+func (c *TCPClient) Query(ctx context.Context, q *dns.Msg, addr netip.AddrPort) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, ErrInvalidQuestion
+	}
+
+	tp, err := c.getPool(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.putPool(tp)
+
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, defaultTimeout))
+	defer cancel()
+	return tp.p.exchange(ctx, q)
+}
+
+// getPool returns the pool of addr. Callers must call putPool after use.
+func (c *TCPClient) getPool(addr netip.AddrPort) (*tcpPool, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if e := c.pools[addr]; e != nil {
+		c.lru.MoveToFront(e)
+		tp := e.Value.(*tcpPool)
+		tp.users++
+		return tp, nil
+	}
+	tp := &tcpPool{
+		addr: addr,
+		p: &streamPool{
+			dial: func(ctx context.Context) (net.Conn, error) {
+				d := new(net.Dialer)
+				return d.DialContext(ctx, "tcp", addr.String())
+			},
+			idleTimeout: c.IdleTimeout,
+		},
+		users: 1,
+	}
+	c.pools[addr] = c.lru.PushFront(tp)
+	c.evict()
+	return tp, nil
+}
+
+func (c *TCPClient) putPool(tp *tcpPool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	tp.users--
+	c.evict()
+}
+
+// evict closes least recently used pools that are not in use until
+// there are no more than MaxPools pools.
+func (c *TCPClient) evict() {
+	maxPools := c.MaxPools
+	if maxPools <= 0 {
+		maxPools = defaultMaxPools
+	}
+	for e := c.lru.Back(); e != nil && c.lru.Len() > maxPools; {
+		prev := e.Prev()
+		if tp := e.Value.(*tcpPool); tp.users == 0 {
+			c.lru.Remove(e)
+			delete(c.pools, tp.addr)
+			tp.p.close()
+		}
+		e = prev
+	}
+}
+
+func (c *TCPClient) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.closed = true
+	for _, e := range c.pools {
+		e.Value.(*tcpPool).p.close()
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package dnsClient
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return c, err
+}
+
+// echoHandler replies an A record with the query id encoded in its address.
+func echoHandler(w dns.ResponseWriter, q *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(127, 0, byte(q.Id>>8), byte(q.Id)),
+	})
+	w.WriteMsg(r)
+}
+
+func Test_TCPClient(t *testing.T) {
+	r := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	cl := &countListener{Listener: l}
+	s := &dns.Server{Listener: cl, Handler: dns.HandlerFunc(echoHandler)}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	addr := l.Addr().(*net.TCPAddr).AddrPort()
+
+	c := NewTCP()
+	defer c.Close()
+
+	// Queries with the same id can be pipelined on one connection.
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 64; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			q.Id = uint16(i % 2)
+			resp, err := c.Query(context.Background(), q, addr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, q.Id, resp.Id)
+			assert.Len(t, resp.Answer, 1)
+		}()
+	}
+	wg.Wait()
+	r.Equal(int32(1), cl.accepted.Load())
+
+	_, err = c.Query(context.Background(), new(dns.Msg), netip.AddrPort{})
+	r.ErrorIs(err, ErrInvalidQuestion)
+}
+
+func startTCPEchoServer(t *testing.T) (*countListener, netip.AddrPort) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cl := &countListener{Listener: l}
+	s := &dns.Server{Listener: cl, Handler: dns.HandlerFunc(echoHandler)}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return cl, l.Addr().(*net.TCPAddr).AddrPort()
+}
+
+func Test_TCPClient_evict(t *testing.T) {
+	r := require.New(t)
+
+	c := NewTCP()
+	defer c.Close()
+	c.MaxPools = 2
+	var ls []*countListener
+	var addrs []netip.AddrPort
+	for i := 0; i < 3; i++ {
+		l, addr := startTCPEchoServer(t)
+		ls, addrs = append(ls, l), append(addrs, addr)
+	}
+	query := func(addr netip.AddrPort) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		_, err := c.Query(context.Background(), q, addr)
+		r.NoError(err)
+	}
+
+	// The pool of the least recently used server is removed.
+	query(addrs[0])
+	query(addrs[1])
+	query(addrs[0])
+	query(addrs[2])
+	r.Len(c.pools, 2)
+	r.NotNil(c.pools[addrs[0]])
+	r.Nil(c.pools[addrs[1]])
+	query(addrs[1])
+	r.Equal(int32(2), ls[1].accepted.Load())
+	r.Equal(int32(1), ls[0].accepted.Load())
+
+	// Pools in use are not removed.
+	tp, err := c.getPool(addrs[2])
+	r.NoError(err)
+	query(addrs[0])
+	r.Len(c.pools, 2)
+	r.NotNil(c.pools[addrs[2]])
+	c.putPool(tp)
+}
+
+func Test_TCPClient_slowResponse(t *testing.T) {
+	r := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+	slowHandler := func(w dns.ResponseWriter, q *dns.Msg) {
+		time.Sleep(time.Millisecond * 300)
+		echoHandler(w, q)
+	}
+	s := &dns.Server{Listener: l, Handler: dns.HandlerFunc(slowHandler)}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	addr := l.Addr().(*net.TCPAddr).AddrPort()
+
+	// Pending queries are not limited by the idle timeout.
+	c := NewTCP()
+	defer c.Close()
+	c.IdleTimeout = time.Millisecond * 100
+	c.Timeout = time.Second * 5
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Query(context.Background(), q, addr)
+	r.NoError(err)
+}
+
+// blockedDial returns a dial func that blocks until unblock is closed.
+func blockedDial(unblock chan struct{}) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		<-unblock
+		c, _ := net.Pipe()
+		return c, nil
+	}
+}
+
+func Test_streamPool_slowDial(t *testing.T) {
+	r := require.New(t)
+
+	unblock := make(chan struct{})
+	p := &streamPool{dial: blockedDial(unblock)}
+	defer p.close()
+
+	// Callers don't wait for the dial after their ctx is done.
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := p.getConn(context.Background())
+		done <- err
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := p.getConn(ctx)
+	r.ErrorIs(err, context.Canceled)
+
+	// Callers share the dial.
+	close(unblock)
+	r.NoError(<-done)
+	sc, reused, err := p.getConn(context.Background())
+	r.NoError(err)
+	r.True(reused)
+	r.Same(p.sc, sc)
+
+	// Close doesn't wait for the dial. Connections that are dialed after
+	// close are closed.
+	unblock = make(chan struct{})
+	p = &streamPool{dial: blockedDial(unblock)}
+	go func() {
+		_, _, err := p.getConn(context.Background())
+		done <- err
+	}()
+	p.close()
+	close(unblock)
+	r.ErrorIs(<-done, ErrClientClosed)
+}
@@ -0,0 +1,59 @@
+package dnsClient
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TLSClient sends queries to a DNS-over-TLS (RFC 7858) server. Its connection
+// is persistent and queries on it are pipelined.
+type TLSClient struct {
+	// IdleTimeout is the time that a connection will be closed if it
+	// has no pending query. Default is 10s.
+	IdleTimeout time.Duration
+	// Timeout is the maximum time of a query. Default is 5s.
+	Timeout time.Duration
+
+	initOnce sync.Once
+	pool     *streamPool
+}
+
+// NewTLS creates a TLSClient that sends queries to addr (host:port).
+// If tlsConfig.ServerName is empty, the host of addr will be used.
+// tlsConfig can be nil.
+func NewTLS(addr string, tlsConfig *tls.Config) *TLSClient {
+	if tlsConfig == nil {
+		tlsConfig = new(tls.Config)
+	}
+	d := &tls.Dialer{Config: tlsConfig}
+	return &TLSClient{
+		pool: &streamPool{
+			dial: func(ctx context.Context) (net.Conn, error) {
+				return d.DialContext(ctx, "tcp", addr)
+			},
+		},
+	}
+}
+
+// Exchange sends q to the server.
+// It waits until the response received or ctx was done.
+// q must have and only have one question.
+func (c *TLSClient) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, ErrInvalidQuestion
+	}
+	c.initOnce.Do(func() { c.pool.idleTimeout = c.IdleTimeout })
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.Timeout, defaultTimeout))
+	defer cancel()
+	return c.pool.exchange(ctx, q)
+}
+
+func (c *TLSClient) Close() error {
+	c.pool.close()
+	return nil
+}
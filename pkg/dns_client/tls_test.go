@@ -0,0 +1,70 @@
+package dnsClient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSignedCert generates a self-signed certificate for serverName.
+func selfSignedCert(t *testing.T, serverName string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func Test_TLSClient(t *testing.T) {
+	r := require.New(t)
+
+	cert, pool := selfSignedCert(t, "dns.test")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	r.NoError(err)
+	s := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dns.HandlerFunc(echoHandler)}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Id = 0x0102
+
+	c := NewTLS(l.Addr().String(), &tls.Config{ServerName: "dns.test", RootCAs: pool})
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		resp, err := c.Exchange(context.Background(), q)
+		r.NoError(err)
+		r.Equal(q.Id, resp.Id)
+		r.Len(resp.Answer, 1)
+	}
+
+	// Wrong server name.
+	c2 := NewTLS(l.Addr().String(), &tls.Config{ServerName: "other.test", RootCAs: pool})
+	defer c2.Close()
+	_, err = c2.Exchange(context.Background(), q)
+	r.Error(err)
+}
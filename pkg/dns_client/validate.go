@@ -0,0 +1,124 @@
+package dnsClient
+
+import (
+	"math/rand"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// ClientStats counts received packets that were dropped by a Client,
+// and accepted responses that were suspicious.
+type ClientStats struct {
+	Malformed uint64 // Invalid messages or not a response.
+	Unmatched uint64 // No pending query has the id and question, including qnames with the wrong case.
+	BadSource uint64 // From an address that the query was not sent to.
+	BadCookie uint64 // Has a client cookie that is not ours.
+	NoCookie  uint64 // Accepted. No cookie from a server that has sent its cookie before.
+}
+
+// Stats returns counters of dropped packets.
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		Malformed: c.malformed.Load(),
+		Unmatched: c.unmatched.Load(),
+		BadSource: c.badSource.Load(),
+		BadCookie: c.badCookie.Load(),
+		NoCookie:  c.noCookie.Load(),
+	}
+}
+
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// randomizeCase randomizes the case of ascii letters in name (DNS 0x20).
+func randomizeCase(name string) string {
+	b := []byte(name)
+	var bits uint64
+	for i, c := range b {
+		if i%64 == 0 {
+			bits = rand.Uint64()
+		}
+		if bits&(1<<(i%64)) == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// restoreCase restores the case of names in r to the case of name, the
+// qname before it was randomized. Servers may compress names against the
+// randomized question, so the randomized case can be in any name that
+// shares trailing labels with name, e.g. targets of NS records.
+func restoreCase(r *dns.Msg, name string) {
+	fix := func(s *string) { *s = restoreSuffixCase(*s, name) }
+	for i := range r.Question {
+		fix(&r.Question[i].Name)
+	}
+	for _, rrs := range [...][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range rrs {
+			fix(&rr.Header().Name)
+			switch v := rr.(type) {
+			case *dns.NS:
+				fix(&v.Ns)
+			case *dns.CNAME:
+				fix(&v.Target)
+			case *dns.DNAME:
+				fix(&v.Target)
+			case *dns.PTR:
+				fix(&v.Ptr)
+			case *dns.MX:
+				fix(&v.Mx)
+			case *dns.SOA:
+				fix(&v.Ns)
+				fix(&v.Mbox)
+			case *dns.SRV:
+				fix(&v.Target)
+			case *dns.SVCB:
+				fix(&v.Target)
+			case *dns.HTTPS:
+				fix(&v.Target)
+			case *dns.RRSIG:
+				fix(&v.SignerName)
+			case *dns.NSEC:
+				fix(&v.NextDomain)
+			}
+		}
+	}
+}
+
+// restoreSuffixCase returns s with its trailing labels that equal (case
+// insensitively) the trailing labels of name in the case of name.
+func restoreSuffixCase(s, name string) string {
+	i, j := len(s), len(name)
+	for i > 0 && j > 0 && asciiLower(s[i-1]) == asciiLower(name[j-1]) {
+		i--
+		j--
+	}
+	// Align to the start of a label in both names.
+	for i < len(s) {
+		if (i == 0 || s[i-1] == '.') && (j == 0 || name[j-1] == '.') {
+			break
+		}
+		i++
+		j++
+	}
+	if i >= len(s) || s[i:] == name[j:] {
+		return s
+	}
+	return s[:i] + name[j:]
+}
+
+func asciiLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c - 'A' + 'a'
+	}
+	return c
+}